@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/drgo/realworld/utils"
+)
+
+// testArticle holds the fields of an article returned by the API that tests check
+type testArticle struct {
+	Slug           string
+	Title          string
+	Favorited      bool
+	FavoritesCount int
+	TagList        []string
+	Author         struct {
+		Username  string
+		Following bool
+	}
+}
+
+// createTestArticle creates an article by u with title and tags and returns it
+func createTestArticle(t *testing.T, s *server, u *testUser, title string, tags ...string) *testArticle {
+	t.Helper()
+	tagList, err := json.Marshal(tags)
+	check(t, err)
+	rec := serveAs(t, s, u, "POST", "/api/articles", `{"article":{"title": `+quoteTest(title)+
+		`,"description": "description","body": "body","tagList": `+string(tagList)+`}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create article %q: got %v %s", title, rec.Code, rec.Body)
+	}
+	var resp struct{ Article testArticle }
+	decodeTest(t, rec, &resp)
+	return &resp.Article
+}
+
+// listTestArticles returns the articles listed by url as seen by u and their total number
+func listTestArticles(t *testing.T, s *server, u *testUser, url string) ([]testArticle, int) {
+	t.Helper()
+	rec := serveAs(t, s, u, "GET", url, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %v %s", url, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Articles      []testArticle
+		ArticlesCount int
+	}
+	decodeTest(t, rec, &resp)
+	return resp.Articles, resp.ArticlesCount
+}
+
+// quoteTest returns s as a JSON string
+func quoteTest(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func TestFeed(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	celeb := registerTestUser(t, s, "celeb")
+	other := registerTestUser(t, s, "other")
+	createTestArticle(t, s, celeb, "First")
+	createTestArticle(t, s, other, "Unfollowed")
+	createTestArticle(t, s, celeb, "Second")
+	createTestArticle(t, s, jake, "Own")
+	if arts, count := listTestArticles(t, s, jake, "/api/articles/feed"); len(arts) != 0 || count != 0 {
+		t.Errorf("want empty feed before following anyone, got %d of %d", len(arts), count)
+	}
+	if rec := serveAs(t, s, jake, "POST", "/api/profiles/celeb/follow", ""); rec.Code != http.StatusOK {
+		t.Fatalf("follow: got %v %s", rec.Code, rec.Body)
+	}
+	arts, count := listTestArticles(t, s, jake, "/api/articles/feed")
+	if count != 2 || len(arts) != 2 || arts[0].Title != "Second" || arts[1].Title != "First" {
+		t.Fatalf("want the 2 articles of celeb, most recent first, got %+v (%d)", arts, count)
+	}
+	if !arts[0].Author.Following {
+		t.Errorf("want the author of feed articles followed, got %+v", arts[0].Author)
+	}
+	if arts, count := listTestArticles(t, s, jake, "/api/articles/feed?limit=1&offset=1"); count != 2 ||
+		len(arts) != 1 || arts[0].Title != "First" {
+		t.Errorf("want the second page of the feed, got %+v (%d)", arts, count)
+	}
+	if rec := serveAs(t, s, nil, "GET", "/api/articles/feed", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("feed without authentication: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestUpdateArticle(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	other := registerTestUser(t, s, "other")
+	art := createTestArticle(t, s, jake, "How to train your dragon", "dragons", "training")
+	url := "/api/articles/" + art.Slug
+	body := `{"article":{"title": "Did you train your dragon?", "tagList": ["dragons"]}}`
+	if rec := serveAs(t, s, other, "PUT", url, body); rec.Code != http.StatusForbidden {
+		t.Errorf("update by another user: got %v, want %v", rec.Code, http.StatusForbidden)
+	}
+	if rec := serveAs(t, s, nil, "PUT", url, body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("update without authentication: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveAs(t, s, jake, "PUT", "/api/articles/no-such-article", body); rec.Code != http.StatusNotFound {
+		t.Errorf("update of unknown article: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	rec := serveAs(t, s, jake, "PUT", url, body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update by the author: got %v %s", rec.Code, rec.Body)
+	}
+	var resp struct{ Article testArticle }
+	decodeTest(t, rec, &resp)
+	if got := resp.Article; got.Slug != "did-you-train-your-dragon" || got.Title != "Did you train your dragon?" ||
+		len(got.TagList) != 1 || got.TagList[0] != "dragons" {
+		t.Errorf("want new title, slug and tags, got %+v", got)
+	}
+	// fields missing from the update are unchanged
+	rec = serveAs(t, s, jake, "PUT", "/api/articles/did-you-train-your-dragon", `{"article":{"body": "new body"}}`)
+	if rec.Code != http.StatusOK || !regexMatch(`"title":"Did you train your dragon\?","description":"description","body":"new body"`,
+		rec.Body.String()) {
+		t.Errorf("partial update: got %v %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeleteArticle(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	other := registerTestUser(t, s, "other")
+	art := createTestArticle(t, s, jake, "Doomed", "doom")
+	url := "/api/articles/" + art.Slug
+	createTestComment(t, s, other, art.Slug, "first!", 0)
+	if rec := serveAs(t, s, other, "DELETE", url, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("delete by another user: got %v, want %v", rec.Code, http.StatusForbidden)
+	}
+	if rec := serveAs(t, s, nil, "GET", url, ""); rec.Code != http.StatusOK {
+		t.Errorf("article after forbidden delete: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, jake, "DELETE", url, ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete by the author: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, nil, "GET", url, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted article: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := serveAs(t, s, nil, "GET", "/api/tags", ""); regexMatch(`doom`, rec.Body.String()) {
+		t.Errorf("tags of deleted article still listed: %s", rec.Body)
+	}
+	if rec := serveAs(t, s, jake, "DELETE", url, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete of deleted article: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestFavoriteArticle(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	fan := registerTestUser(t, s, "fan")
+	art := createTestArticle(t, s, jake, "Popular")
+	url := "/api/articles/" + art.Slug
+	for _, tt := range []struct {
+		u         *testUser
+		method    string
+		favorited bool
+		count     int
+	}{
+		{fan, "POST", true, 1},
+		{fan, "POST", true, 1}, // favoriting twice counts once
+		{jake, "POST", true, 2},
+		{fan, "DELETE", false, 1},
+	} {
+		rec := serveAs(t, s, tt.u, tt.method, url+"/favorite", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s favorite by %s: got %v %s", tt.method, tt.u.Username, rec.Code, rec.Body)
+		}
+		var resp struct{ Article testArticle }
+		decodeTest(t, rec, &resp)
+		if resp.Article.Favorited != tt.favorited || resp.Article.FavoritesCount != tt.count {
+			t.Errorf("%s favorite by %s: got favorited=%v favoritesCount=%d", tt.method, tt.u.Username,
+				resp.Article.Favorited, resp.Article.FavoritesCount)
+		}
+	}
+	// favorited is derived for each viewer
+	for _, tt := range []struct {
+		u         *testUser
+		favorited bool
+	}{
+		{jake, true},
+		{fan, false},
+		{nil, false},
+	} {
+		var resp struct{ Article testArticle }
+		decodeTest(t, serveAs(t, s, tt.u, "GET", url, ""), &resp)
+		if resp.Article.Favorited != tt.favorited || resp.Article.FavoritesCount != 1 {
+			t.Errorf("viewer %v: got favorited=%v favoritesCount=%d", tt.u, resp.Article.Favorited,
+				resp.Article.FavoritesCount)
+		}
+	}
+	if rec := serveAs(t, s, nil, "POST", url+"/favorite", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("favorite without authentication: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveAs(t, s, fan, "POST", "/api/articles/no-such-article/favorite", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("favorite of unknown article: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestListArticlesFilters(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	fan := registerTestUser(t, s, "fan")
+	for i := 1; i <= 5; i++ {
+		art := createTestArticle(t, s, jake, fmt.Sprintf("Article %c", 'A'+i-1), fmt.Sprintf("tag%d", i%2))
+		if i != 3 {
+			if rec := serveAs(t, s, fan, "POST", "/api/articles/"+art.Slug+"/favorite", ""); rec.Code != http.StatusOK {
+				t.Fatalf("favorite: got %v %s", rec.Code, rec.Body)
+			}
+		}
+	}
+	createTestArticle(t, s, fan, "By fan", "tag1")
+	for _, tt := range []struct {
+		url    string
+		titles []string
+		count  int
+	}{
+		{"/api/articles?limit=2", []string{"By fan", "Article E"}, 6},
+		{"/api/articles?favorited=fan", []string{"Article E", "Article D", "Article B", "Article A"}, 4},
+		// paging applies after filtering and the count is that of all matching articles
+		{"/api/articles?favorited=fan&limit=2&offset=1", []string{"Article D", "Article B"}, 4},
+		{"/api/articles?favorited=fan&offset=4", nil, 4},
+		{"/api/articles?favorited=jake", nil, 0},
+		{"/api/articles?favorited=nobody", nil, 0},
+		{"/api/articles?author=fan", []string{"By fan"}, 1},
+		{"/api/articles?tag=tag1&favorited=fan&limit=1", []string{"Article E"}, 2},
+		{"/api/articles?tag=tag1&author=jake", []string{"Article E", "Article C", "Article A"}, 3},
+	} {
+		arts, count := listTestArticles(t, s, nil, tt.url)
+		var titles []string
+		for _, art := range arts {
+			titles = append(titles, art.Title)
+		}
+		if count != tt.count || fmt.Sprint(titles) != fmt.Sprint(tt.titles) {
+			t.Errorf("GET %s: got %v (%d), want %v (%d)", tt.url, titles, count, tt.titles, tt.count)
+		}
+	}
+}
+
+func TestListArticlesQuotedTag(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	createTestArticle(t, s, jake, "Quoted", `it's "quoted"`)
+	createTestArticle(t, s, jake, "Plain", "plain")
+	for _, tt := range []struct {
+		url   string
+		count int
+	}{
+		{"/api/articles?tag=" + url.QueryEscape(`it's "quoted"`), 1},
+		{"/api/articles?tag=" + url.QueryEscape(`' OR '1'='1`), 0},
+		{"/api/articles?author=" + url.QueryEscape(`jake' OR '1'='1`), 0},
+	} {
+		if arts, count := listTestArticles(t, s, nil, tt.url); count != tt.count || len(arts) != tt.count {
+			t.Errorf("GET %s: got %d articles (%d), want %d", tt.url, len(arts), count, tt.count)
+		}
+	}
+	if rec := serveAs(t, s, nil, "GET", "/api/tags", ""); !regexMatch(`"it's \\"quoted\\""`, rec.Body.String()) {
+		t.Errorf("want the quoted tag listed, got %s", rec.Body)
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	long := strings.Repeat("x", 100) // slugified to utils.MaxSlugLength characters
+	for _, tt := range []struct {
+		title, slug string
+	}{
+		{"How to train your dragon", "how-to-train-your-dragon"},
+		{"How to train your dragon!", "how-to-train-your-dragon-2"},
+		{"How to train your dragon?", "how-to-train-your-dragon-3"},
+		{"?!", "article"},
+		{"!?", "article-2"},
+		{long, utils.Slugify(long)},
+		{long, utils.TruncateSlug(utils.Slugify(long), utils.MaxSlugLength-2) + "-2"},
+		{long, utils.TruncateSlug(utils.Slugify(long), utils.MaxSlugLength-2) + "-3"},
+	} {
+		art := createTestArticle(t, s, jake, tt.title)
+		if art.Slug != tt.slug || len(art.Slug) > utils.MaxSlugLength {
+			t.Errorf("title %q: got slug %q, want %q", tt.title, art.Slug, tt.slug)
+		}
+	}
+	// an article keeps its slug when updated with the same title
+	rec := serveAs(t, s, jake, "PUT", "/api/articles/how-to-train-your-dragon-2",
+		`{"article":{"title": "How to train your dragon!", "body": "new body"}}`)
+	if rec.Code != http.StatusOK || !regexMatch(`"slug":"how-to-train-your-dragon-2"`, rec.Body.String()) {
+		t.Errorf("update with the same title: got %v %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRedirectOldSlug(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	createTestArticle(t, s, jake, "Old title")
+	for _, tt := range []struct{ slug, title string }{
+		{"old-title", "New title"},
+		{"new-title", "Newest title"},
+	} {
+		rec := serveAs(t, s, jake, "PUT", "/api/articles/"+tt.slug, `{"article":{"title": "`+tt.title+`"}}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("rename to %q: got %v %s", tt.title, rec.Code, rec.Body)
+		}
+	}
+	for _, tt := range []struct {
+		url, location string
+	}{
+		{"/api/articles/old-title", "/api/articles/newest-title"},
+		{"/api/articles/new-title", "/api/articles/newest-title"},
+		{"/api/articles/old-title?format=full&x=%22y%22", "/api/articles/newest-title?format=full&x=%22y%22"},
+	} {
+		rec := serveAs(t, s, nil, "GET", tt.url, "")
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != tt.location {
+			t.Errorf("GET %s: got %v to %q, want %v to %q", tt.url, rec.Code, rec.Header().Get("Location"),
+				http.StatusMovedPermanently, tt.location)
+		}
+	}
+	if rec := serveAs(t, s, nil, "GET", "/api/articles/newest-title", ""); rec.Code != http.StatusOK {
+		t.Errorf("current slug: got %v %s", rec.Code, rec.Body)
+	}
+	// a previous slug stays taken so that its redirect keeps working
+	if art := createTestArticle(t, s, jake, "Old title"); art.Slug != "old-title-2" {
+		t.Errorf("want a previous slug kept for its redirect, got new slug %q", art.Slug)
+	}
+}
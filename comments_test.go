@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// testComment holds the fields of a comment returned by the API that tests check
+type testComment struct {
+	ID       int64
+	Body     string
+	ParentID *int64
+	Author   struct{ Username string }
+}
+
+// createTestComment adds a comment by u to the article with slug, replying to parentID if not 0,
+// and returns it
+func createTestComment(t *testing.T, s *server, u *testUser, slug, body string, parentID int64) *testComment {
+	t.Helper()
+	parent := "null"
+	if parentID != 0 {
+		parent = fmt.Sprint(parentID)
+	}
+	rec := serveAs(t, s, u, "POST", "/api/articles/"+slug+"/comments",
+		`{"comment":{"body": `+quoteTest(body)+`, "parentID": `+parent+`}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create comment %q: got %v %s", body, rec.Code, rec.Body)
+	}
+	var resp struct{ Comment testComment }
+	decodeTest(t, rec, &resp)
+	return &resp.Comment
+}
+
+func TestDeleteComment(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	other := registerTestUser(t, s, "other")
+	art := createTestArticle(t, s, jake, "Commented")
+	c := createTestComment(t, s, other, art.Slug, "first!", 0)
+	url := fmt.Sprintf("/api/articles/%s/comments/%d", art.Slug, c.ID)
+	// not even the author of the article can delete the comments of others
+	if rec := serveAs(t, s, jake, "DELETE", url, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("delete by another user: got %v, want %v", rec.Code, http.StatusForbidden)
+	}
+	if rec := serveAs(t, s, other, "DELETE", "/api/articles/no-such-article/comments/"+fmt.Sprint(c.ID), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete through another article: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := serveAs(t, s, other, "DELETE", url, ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete by the author: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, nil, "GET", url, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleted comment: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+// listTestComments returns the bodies of the comments listed by url
+func listTestComments(t *testing.T, s *server, url string) []string {
+	t.Helper()
+	rec := serveAs(t, s, nil, "GET", url, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: got %v %s", url, rec.Code, rec.Body)
+	}
+	var resp struct{ Comments []testComment }
+	decodeTest(t, rec, &resp)
+	var bodies []string
+	for _, c := range resp.Comments {
+		bodies = append(bodies, c.Body)
+	}
+	return bodies
+}
+
+func TestGetComments(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	art := createTestArticle(t, s, jake, "Commented")
+	other := createTestArticle(t, s, jake, "Other")
+	var ids []int64
+	for _, body := range []string{"one", "two", "three"} {
+		c := createTestComment(t, s, jake, art.Slug, body, 0)
+		if c.Body != body || c.Author.Username != "jake" || c.ParentID != nil {
+			t.Errorf("want the created comment returned, got %+v", c)
+		}
+		ids = append(ids, c.ID)
+	}
+	rec := serveAs(t, s, nil, "GET", fmt.Sprintf("/api/articles/%s/comments/%d", art.Slug, ids[1]), "")
+	if rec.Code != http.StatusOK || !regexMatch(`^{"comment":{"id":\d+,"body":"two"`, rec.Body.String()) {
+		t.Errorf("GET single comment: got %v %s", rec.Code, rec.Body)
+	}
+	for _, url := range []string{
+		fmt.Sprintf("/api/articles/%s/comments/%d", other.Slug, ids[1]),
+		fmt.Sprintf("/api/articles/%s/comments/%d", art.Slug, ids[2]+1),
+		fmt.Sprintf("/api/articles/%s/comments/x", art.Slug),
+	} {
+		if rec := serveAs(t, s, nil, "GET", url, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %v, want %v", url, rec.Code, http.StatusNotFound)
+		}
+	}
+	for _, tt := range []struct {
+		query  string
+		bodies []string
+	}{
+		{"", []string{"three", "two", "one"}},
+		{"?order=asc", []string{"one", "two", "three"}},
+		{"?limit=2", []string{"three", "two"}},
+		{"?limit=2&offset=2", []string{"one"}},
+		{"?order=asc&limit=1&offset=1", []string{"two"}},
+		{"?offset=3", nil},
+	} {
+		url := "/api/articles/" + art.Slug + "/comments" + tt.query
+		if got := listTestComments(t, s, url); fmt.Sprint(got) != fmt.Sprint(tt.bodies) {
+			t.Errorf("GET %s: got %v, want %v", url, got, tt.bodies)
+		}
+	}
+	if got := listTestComments(t, s, "/api/articles/"+other.Slug+"/comments"); len(got) != 0 {
+		t.Errorf("want no comments on another article, got %v", got)
+	}
+}
+
+func TestCommentReplies(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	art := createTestArticle(t, s, jake, "Commented")
+	other := createTestArticle(t, s, jake, "Other")
+	first := createTestComment(t, s, jake, art.Slug, "first", 0)
+	second := createTestComment(t, s, jake, art.Slug, "second", 0)
+	reply := createTestComment(t, s, jake, art.Slug, "reply to first", first.ID)
+	if reply.ParentID == nil || *reply.ParentID != first.ID {
+		t.Errorf("want a reply to comment %d, got %+v", first.ID, reply)
+	}
+	createTestComment(t, s, jake, art.Slug, "reply to reply", reply.ID)
+	createTestComment(t, s, jake, art.Slug, "reply to second", second.ID)
+	// each top-level comment is followed by its replies and paging counts top-level comments only
+	for _, tt := range []struct {
+		query  string
+		bodies []string
+	}{
+		{"", []string{"second", "reply to second", "first", "reply to first", "reply to reply"}},
+		{"?order=asc", []string{"first", "reply to first", "reply to reply", "second", "reply to second"}},
+		{"?limit=1&offset=1", []string{"first", "reply to first", "reply to reply"}},
+	} {
+		url := "/api/articles/" + art.Slug + "/comments" + tt.query
+		if got := listTestComments(t, s, url); fmt.Sprint(got) != fmt.Sprint(tt.bodies) {
+			t.Errorf("GET %s: got %v, want %v", url, got, tt.bodies)
+		}
+	}
+
+	// replies can be nested up to maxReplyDepth levels
+	parent := second.ID
+	for depth := 1; depth <= maxReplyDepth; depth++ {
+		parent = createTestComment(t, s, jake, art.Slug, fmt.Sprintf("depth %d", depth), parent).ID
+	}
+	otherComment := createTestComment(t, s, jake, other.Slug, "elsewhere", 0)
+	for _, tt := range []struct {
+		parentID int64
+		regex    string
+	}{
+		{parent, `{"errors":{"parentID":\["is nested too deeply \(maximum is 5 levels\)"\]}}`},
+		{otherComment.ID, `{"errors":{"parentID":\["is invalid"\]}}`},
+		{parent + 1000, `{"errors":{"parentID":\["is invalid"\]}}`},
+	} {
+		rec := serveAs(t, s, jake, "POST", "/api/articles/"+art.Slug+"/comments",
+			fmt.Sprintf(`{"comment":{"body": "reply", "parentID": %d}}`, tt.parentID))
+		if rec.Code != http.StatusUnprocessableEntity || !regexMatch(tt.regex, rec.Body.String()) {
+			t.Errorf("reply to %d: got %v %s, want %v %s", tt.parentID, rec.Code, rec.Body,
+				http.StatusUnprocessableEntity, tt.regex)
+		}
+	}
+
+	// deleting a comment deletes its replies
+	if rec := serveAs(t, s, jake, "DELETE", fmt.Sprintf("/api/articles/%s/comments/%d", art.Slug, first.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: got %v %s", rec.Code, rec.Body)
+	}
+	if got := listTestComments(t, s, "/api/articles/"+art.Slug+"/comments?order=asc&limit=1"); len(got) != 2+maxReplyDepth {
+		t.Errorf("want the replies of the deleted comment deleted, got %v", got)
+	}
+}
+
+func TestUpdateComment(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	jane := registerTestUser(t, s, "jane")
+	mod := registerTestUser(t, s, "mod")
+	_, _, err := s.Store.db.Exec("UPDATE User SET moderator=1 WHERE username=$username", Args{"$username": mod.Username})
+	check(t, err)
+	art := createTestArticle(t, s, jake, "Commented")
+	c := createTestComment(t, s, jane, art.Slug, "first", 0)
+	url := fmt.Sprintf("/api/articles/%s/comments/%d", art.Slug, c.ID)
+
+	for _, tt := range []struct {
+		u    *testUser
+		code int
+	}{
+		{nil, http.StatusUnauthorized},
+		{jake, http.StatusForbidden}, // the article author is not the comment author
+	} {
+		if rec := serveAs(t, s, tt.u, "PUT", url, `{"comment":{"body": "hijacked"}}`); rec.Code != tt.code {
+			t.Errorf("PUT %s: got %v %s, want %v", url, rec.Code, rec.Body, tt.code)
+		}
+	}
+	for _, body := range []string{"second", "second", "third"} { // an unchanged body adds no history
+		rec := serveAs(t, s, jane, "PUT", url, `{"comment":{"body": "`+body+`"}}`)
+		var resp struct{ Comment testComment }
+		decodeTest(t, rec, &resp)
+		if rec.Code != http.StatusOK || resp.Comment.Body != body {
+			t.Fatalf("PUT %s: got %v %s, want body %q", url, rec.Code, rec.Body, body)
+		}
+	}
+	if got := listTestComments(t, s, "/api/articles/"+art.Slug+"/comments"); fmt.Sprint(got) != "[third]" {
+		t.Errorf("want the updated comment listed, got %v", got)
+	}
+
+	// only moderators can read the history
+	for _, tt := range []struct {
+		u    *testUser
+		code int
+	}{
+		{nil, http.StatusUnauthorized},
+		{jane, http.StatusForbidden},
+		{jake, http.StatusForbidden},
+	} {
+		if rec := serveAs(t, s, tt.u, "GET", url+"/history", ""); rec.Code != tt.code {
+			t.Errorf("GET %s/history: got %v %s, want %v", url, rec.Code, rec.Body, tt.code)
+		}
+	}
+	rec := serveAs(t, s, mod, "GET", url+"/history", "")
+	var resp struct{ History []struct{ Body string } }
+	decodeTest(t, rec, &resp)
+	if rec.Code != http.StatusOK || fmt.Sprint(resp.History) != "[{second} {first}]" {
+		t.Errorf("GET %s/history: got %v %s, want the previous bodies, most recent first", url, rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, mod, "GET", fmt.Sprintf("/api/articles/%s/comments/%d/history", art.Slug, c.ID+1), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("history of an unknown comment: got %v %s, want %v", rec.Code, rec.Body, http.StatusNotFound)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/drgo/realworld/errors"
 	"github.com/drgo/realworld/sessions"
@@ -15,9 +16,10 @@ type Ctx struct {
 	Session *sessions.Session
 }
 
-// Store returns the server store
+// Store returns the server store bound to the request context so that its queries are
+// interrupted if the client disconnects
 func (ctx *Ctx) Store() *Store {
-	return ctx.Server.Store
+	return ctx.Server.Store.WithContext(ctx.Req.Context())
 }
 
 // Authenticated convenient way to check if a user is authenticated.
@@ -32,6 +34,19 @@ func (ctx *Ctx) Authenticated(dx errors.Diag) bool {
 	return true
 }
 
+// ViewerID returns the id of the authenticated user or 0 if the request is not authenticated.
+// Unlike Authenticated, it does not send an error; use it for routes where authentication is optional
+func (ctx *Ctx) ViewerID() int64 {
+	if ctx.Session == nil {
+		s, err := ctx.Server.Sessions.Authenticate(ctx.Res, ctx.Req)
+		if err != nil {
+			return 0
+		}
+		ctx.Session = s
+	}
+	return ctx.Session.UserID
+}
+
 //QueryParams convenient way to extract query parameters from the current request
 func (ctx *Ctx) QueryParams(key string) (values []string, n int) {
 	if values, ok := ctx.Req.URL.Query()[key]; ok {
@@ -39,3 +54,22 @@ func (ctx *Ctx) QueryParams(key string) (values []string, n int) {
 	}
 	return []string{}, 0
 }
+
+// maxPageSize caps the number of records a client can request in one page
+const maxPageSize = 100
+
+// Pagination extracts the limit and offset query parameters from the current request.
+// Missing or invalid values are replaced by the supplied defaults
+func (ctx *Ctx) Pagination(limit, offset int) (int, int) {
+	if values, n := ctx.QueryParams("limit"); n > 0 {
+		if v, err := strconv.Atoi(values[0]); err == nil && v > 0 && v <= maxPageSize {
+			limit = v
+		}
+	}
+	if values, n := ctx.QueryParams("offset"); n > 0 {
+		if v, err := strconv.Atoi(values[0]); err == nil && v >= 0 {
+			offset = v
+		}
+	}
+	return limit, offset
+}
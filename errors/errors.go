@@ -18,8 +18,43 @@ type (
 	// such as "user.Lookup".
 	Op   string
 	Kind int
+	// Fields holds messages describing problems with specific input fields
+	// keyed by field name, eg {"email": ["has already been taken"]}
+	Fields map[string][]string
 )
 
+// Kinds of errors. The Kind of an error determines its default HTTP status
+const (
+	Other       Kind = iota // Unclassified error
+	NotFound                // Item does not exist
+	Permission              // Permission denied
+	Invalid                 // Invalid input, eg failed validation
+	Timeout                 // Operation took too long, eg a database query timed out
+	Unavailable             // Operation was canceled, eg the client disconnected
+)
+
+// Status returns the HTTP status code corresponding to Kind k
+func (k Kind) Status() int {
+	switch k {
+	case NotFound:
+		return http.StatusNotFound
+	case Permission:
+		return http.StatusForbidden
+	case Invalid:
+		return http.StatusUnprocessableEntity
+	case Timeout:
+		return http.StatusGatewayTimeout
+	case Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Add appends msg to the messages of field
+func (f Fields) Add(field, msg string) {
+	f[field] = append(f[field], msg)
+}
+
 // Diag holds diagnostic info
 type Diag struct {
 	// Path is the path name of the .
@@ -76,10 +111,12 @@ type Error struct {
 	Err error `json:"error,omitempty"`
 	// Status is HTTP status codes
 	Status int `json:"status,omitempty"`
+	// Fields holds field-level errors, if any
+	Fields Fields `json:"fields,omitempty"`
 }
 
 func (e *Error) isZero() bool {
-	return e.Path == "" && e.User == "" && e.Op == "" && e.Kind == 0 && e.Err == nil
+	return e.Path == "" && e.User == "" && e.Op == "" && e.Kind == 0 && e.Err == nil && len(e.Fields) == 0
 }
 
 // Error implements the error interface
@@ -107,7 +144,8 @@ func (e *Error) Error() string {
 	// 	pad(b, ": ")
 	// 	// b.WriteString(e.Kind.String())
 	// }
-	if e.Status != 0 {
+	// do not repeat a status inherited from the underlying error
+	if prev, ok := e.Err.(*Error); e.Status != 0 && !(ok && prev.Status == e.Status) {
 		pad(b, ": ")
 		b.WriteString(http.StatusText(e.Status))
 	}
@@ -127,6 +165,12 @@ func (e *Error) Error() string {
 		pad(b, ": ")
 		b.WriteString(e.Detail)
 	}
+	for field, msgs := range e.Fields {
+		for _, msg := range msgs {
+			pad(b, "; ")
+			b.WriteString(field + " " + msg)
+		}
+	}
 	if b.Len() == 0 {
 		return "no error"
 	}
@@ -195,6 +239,8 @@ func E(args ...interface{}) error {
 			e.Detail = arg
 		case Kind:
 			e.Kind = arg
+		case Fields:
+			e.Fields = arg
 		case *Error:
 			// Make a copy
 			copy := *arg
@@ -207,6 +253,17 @@ func E(args ...interface{}) error {
 			return Errorf("unknown type %T, value %v in error call", arg, arg)
 		}
 	}
+	if prev, ok := e.Err.(*Error); ok && e.Kind == Other {
+		e.Kind = prev.Kind
+	}
+	// the status defaults to that of the underlying error or to that of the error kind
+	if e.Status == 0 {
+		if prev, ok := e.Err.(*Error); ok && prev.Status != 0 {
+			e.Status = prev.Status
+		} else if e.Kind != Other {
+			e.Status = e.Kind.Status()
+		}
+	}
 	return e
 }
 
@@ -294,15 +351,31 @@ func Is(kind Kind, err error) bool {
 	if !ok {
 		return false
 	}
-	// if e.Kind != Other {
-	// 	return e.Kind == kind
-	// }
+	if e.Kind != Other {
+		return e.Kind == kind
+	}
 	if e.Err != nil {
 		return Is(kind, e.Err)
 	}
 	return false
 }
 
+// FieldsOf returns the field-level errors carried by err or by any error it wraps.
+// It returns nil if there are none
+func FieldsOf(err error) Fields {
+	e, ok := err.(*Error)
+	if !ok {
+		return nil
+	}
+	if len(e.Fields) > 0 {
+		return e.Fields
+	}
+	if e.Err != nil {
+		return FieldsOf(e.Err)
+	}
+	return nil
+}
+
 // Recover recovers from panic and send an internalservererror to client
 func Recover(w http.ResponseWriter) {
 	err := recover()
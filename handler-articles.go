@@ -2,6 +2,9 @@ package main
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/drgo/realworld/errors"
 	"github.com/drgo/realworld/sessions"
@@ -14,19 +17,29 @@ type articleModel struct {
 	ID              int64    `json:"id"`
 	Author          int64    `json:"author"`
 	Slug            string   `json:"slug"`
-	Title           string   `json:"title"`
-	Description     string   `json:"description"`
-	Body            string   `json:"body"`
+	Title           string   `json:"title" validate:"required,max=200"`
+	Description     string   `json:"description" validate:"required,max=500"`
+	Body            string   `json:"body" validate:"required,max=100000"`
 	Favourited      bool     `json:"favorited"`
 	FavouritesCount int64    `json:"favoritesCount"`
-	TagList         []string `json:"tagList"`
+	TagList         []string `json:"tagList" validate:"max=20"`
 }
 
 type commentModel struct {
 	ID        int64  `json:"id"`
 	Author    int64  `json:"author"`
 	ArticleID int64  `json:"articleID"`
-	Body      string `json:"body"`
+	Body      string `json:"body" validate:"required,max=10000"`
+	// ParentID if present identifies the comment, of the same article, this comment replies to
+	ParentID *int64 `json:"parentID"`
+}
+
+// used to decode payload for article update; fields missing from the payload are nil and left unchanged
+type articleUpdateModel struct {
+	Title       *string  `json:"title" validate:"required,max=200"`
+	Description *string  `json:"description" validate:"required,max=500"`
+	Body        *string  `json:"body" validate:"required,max=100000"`
+	TagList     []string `json:"tagList" validate:"max=20"`
 }
 
 // ServeArticles handles "/api/articles/*"
@@ -49,24 +62,59 @@ func ServeArticles(ctx *Ctx) error {
 	slug, ctx.Req.URL.Path = utils.ShiftPath(dx.Path)
 	//GET /api/articles/feed
 	if slug == "feed" {
-		//FIXME: make user-specific
-		return articlesList(ctx, "")
+		if dx.Method != "GET" {
+			return errors.E(dx, http.StatusMethodNotAllowed)
+		}
+		if ctx.Authenticated(dx) {
+			return articlesFeed(ctx, ctx.Session.UserID)
+		}
+		return nil
 	}
 	action, ctx.Req.URL.Path = utils.ShiftPath(ctx.Req.URL.Path)
 	_ = errors.Debug && errors.Logln(slug, action)
 	switch action {
 	case "comments": ///api/articles/:slug/comments
-		switch dx.Method {
-		case "GET":
-			return articlesListComments(ctx, slug, 0)
-		case "POST":
+		var id string
+		id, ctx.Req.URL.Path = utils.ShiftPath(ctx.Req.URL.Path)
+		if id == "" {
+			switch dx.Method {
+			case "GET":
+				return articlesListComments(ctx, slug, 0)
+			case "POST":
+				if ctx.Authenticated(dx) {
+					return articlesCreateComment(ctx, slug, ctx.Session.UserID)
+				}
+			default:
+				return errors.E(dx, http.StatusMethodNotAllowed)
+			}
+			return nil
+		}
+		// /api/articles/:slug/comments/:id
+		commentID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return errors.E(dx, http.StatusNotFound)
+		}
+		var sub string
+		sub, ctx.Req.URL.Path = utils.ShiftPath(ctx.Req.URL.Path)
+		switch {
+		case sub == "history": // GET /api/articles/:slug/comments/:id/history
+			if dx.Method != "GET" {
+				return errors.E(dx, http.StatusMethodNotAllowed)
+			}
 			if ctx.Authenticated(dx) {
-				return articlesCreateComment(ctx, slug, ctx.Session.UserID)
+				return articlesCommentHistory(ctx, slug, commentID, ctx.Session.UserID)
 			}
-		case "DELETE":
-			//FIXME:
+		case sub != "":
+			return errors.E(dx, http.StatusNotFound)
+		case dx.Method == "GET":
+			return articlesListComments(ctx, slug, commentID)
+		case dx.Method == "PUT":
 			if ctx.Authenticated(dx) {
-				return nil
+				return articlesUpdateComment(ctx, slug, commentID, ctx.Session.UserID)
+			}
+		case dx.Method == "DELETE":
+			if ctx.Authenticated(dx) {
+				return articlesDeleteComment(ctx, slug, commentID, ctx.Session.UserID)
 			}
 		default:
 			return errors.E(dx, http.StatusMethodNotAllowed)
@@ -75,13 +123,18 @@ func ServeArticles(ctx *Ctx) error {
 		if ctx.Authenticated(dx) {
 			return articlesFavourite(ctx, slug, ctx.Session.UserID, dx.Method == "POST")
 		}
-	case "": // GET OR DELETE /api/articles/:slug
+	case "": // GET, PUT OR DELETE /api/articles/:slug
 		switch dx.Method {
 		case "GET":
 			return articlesList(ctx, slug)
+		case "PUT":
+			if ctx.Authenticated(dx) {
+				return articlesUpdate(ctx, slug, ctx.Session.UserID)
+			}
 		case "DELETE":
-			//FIXME:
-			return nil
+			if ctx.Authenticated(dx) {
+				return articlesDelete(ctx, slug, ctx.Session.UserID)
+			}
 		default:
 			return errors.E(dx, http.StatusMethodNotAllowed)
 		}
@@ -100,9 +153,12 @@ func ServeArticles(ctx *Ctx) error {
 // Offset/skip number of articles (default is 0): ?offset=0
 // Authentication optional, will return multiple articles, ordered by most recent first
 // /api/articles/:slug -> No authentication required, will return single article
+// or redirect (301) to the current slug if slug is a previous slug of an article
 func articlesList(ctx *Ctx, slug string) error {
 	dx := errors.D(ctx.Req, "articlesGet")
 	opt := ctx.Store().DefaultListArticlesOptions(slug)
+	opt.Limit, opt.Offset = ctx.Pagination(opt.Limit, opt.Offset)
+	opt.ViewerID = ctx.ViewerID()
 	// extract filters
 	if values, n := ctx.QueryParams("author"); n > 0 {
 		opt.Author = values[0] // only use first author parameter
@@ -114,6 +170,34 @@ func articlesList(ctx *Ctx, slug string) error {
 		opt.FavoritedBy = values[0] // only use first favorited parameter
 	}
 	json, err := ctx.Store().ListArticlesJSON(opt)
+	if err != nil {
+		if slug != "" { // is slug a previous slug of an article whose title has changed
+			if current, err := ctx.Store().CurrentSlug(slug); err == nil {
+				location := "/api/articles/" + url.PathEscape(current)
+				if ctx.Req.URL.RawQuery != "" {
+					location += "?" + ctx.Req.URL.RawQuery
+				}
+				http.Redirect(ctx.Res, ctx.Req, location, http.StatusMovedPermanently)
+				return nil
+			}
+		}
+		return errors.E(dx, err, http.StatusNotFound)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+}
+
+// Feed Articles
+// GET /api/articles/feed
+// Can also take limit and offset query parameters like List Articles
+// Authentication required, will return multiple articles created by followed users,
+// ordered by most recent first
+func articlesFeed(ctx *Ctx, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesFeed")
+	opt := ctx.Store().DefaultListArticlesOptions("")
+	opt.Limit, opt.Offset = ctx.Pagination(opt.Limit, opt.Offset)
+	opt.FeedOf = userID
+	opt.ViewerID = userID
+	json, err := ctx.Store().ListArticlesJSON(opt)
 	if err != nil {
 		return errors.E(dx, err, http.StatusNotFound)
 	}
@@ -142,11 +226,14 @@ func articlesCreate(ctx *Ctx, session *sessions.Session) error {
 	if err != nil {
 		return errors.E(dx, err, http.StatusBadRequest)
 	}
+	if payload.Art == nil {
+		return errors.E(dx, errors.Invalid, errors.Fields{"article": {"can't be blank"}})
+	}
+	if fields := utils.Validate(&payload); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
 	art := payload.Art
 	art.Author = session.UserID
-	//TODO: validate inputs
-	//FIXME: make sure slugs are unique
-	art.Slug = utils.Slugify(art.Title)
 	json, err := ctx.Store().CreateArticle(art)
 	if err != nil {
 		return errors.E(dx, err, http.StatusInternalServerError)
@@ -154,6 +241,50 @@ func articlesCreate(ctx *Ctx, session *sessions.Session) error {
 	return utils.SendJSON(ctx.Res, http.StatusOK, json)
 }
 
+// Update Article
+// PUT /api/articles/:slug
+// Example request body:
+// {
+//   "article": {
+//     "title": "Did you train your dragon?"
+//   }
+// }
+// Authentication required, returns the updated Article
+// Optional fields: title, description, body, tagList
+// The slug also gets updated when the title is changed
+func articlesUpdate(ctx *Ctx, slug string, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesUpdate")
+	var payload struct {
+		Art *articleUpdateModel `json:"article"`
+	}
+	err := utils.DecodeJSONBody(ctx.Res, ctx.Req, &payload)
+	if err != nil {
+		return errors.E(dx, err, http.StatusBadRequest)
+	}
+	if payload.Art == nil {
+		return errors.E(dx, errors.Invalid, errors.Fields{"article": {"can't be blank"}})
+	}
+	if fields := utils.Validate(&payload); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
+	json, err := ctx.Store().UpdateArticle(slug, userID, payload.Art)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+}
+
+// Delete Article
+// DELETE /api/articles/:slug
+// Authentication required, only the author can delete an article
+func articlesDelete(ctx *Ctx, slug string, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesDelete")
+	if err := ctx.Store().DeleteArticle(slug, userID); err != nil {
+		return errors.E(dx, err)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, []byte("{}"))
+}
+
 // Favorite Article
 // POST /api/articles/:slug/favorite
 // Unfavorite Article
@@ -164,23 +295,48 @@ func articlesFavourite(ctx *Ctx, slug string, userID int64, favourited bool) err
 	dx := errors.D(ctx.Req, "articlesFavourite")
 	json, err := ctx.Store().FavouriteArticle(slug, userID, favourited)
 	if err != nil {
-		return errors.E(dx, err, http.StatusInternalServerError)
+		return errors.E(dx, err)
 	}
 	return utils.SendJSON(ctx.Res, http.StatusOK, json)
 }
 
 // Get Comments from an Article
-// GET /api/articles/:slug/comments
-// Authentication optional, returns multiple comments
+// GET /api/articles/:slug/comments and GET /api/articles/:slug/comments/:id
+// /api/articles/:slug/comments -> returns multiple comments in thread order: each top-level comment
+// (parentID is null) is followed by its replies, oldest first, which are followed by their own replies.
+// Top-level comments are most recent first by default and can be paged (with all their replies):
+// Limit number of top-level comments (default is all): ?limit=20
+// Offset/skip number of top-level comments (default is 0): ?offset=0
+// Oldest first: ?order=asc
+// /api/articles/:slug/comments/:id -> returns a single comment
+// Authentication optional
 func articlesListComments(ctx *Ctx, slug string, commentID int64) error {
 	dx := errors.D(ctx.Req, "articlesListComments")
-	json, err := ctx.Store().ListArticleCommentsJSON(slug, 0)
+	opt := ctx.Store().DefaultListCommentsOptions(slug)
+	opt.CommentID = commentID
+	opt.Limit, opt.Offset = ctx.Pagination(opt.Limit, opt.Offset)
+	if values, n := ctx.QueryParams("order"); n > 0 {
+		opt.Ascending = strings.EqualFold(values[0], "asc")
+	}
+	json, err := ctx.Store().ListArticleCommentsJSON(opt)
 	if err != nil {
 		return errors.E(dx, err, http.StatusNotFound)
 	}
 	return utils.SendJSON(ctx.Res, http.StatusOK, json)
 }
 
+// Add Comments to an Article
+// POST /api/articles/:slug/comments
+// Example request body:
+// {
+//   "comment": {
+//     "body": "His name was my name too.",
+//     "parentID": 1
+//   }
+// }
+// Authentication required, returns the created Comment
+// Required field: body
+// Optional field: parentID of the comment being replied to
 func articlesCreateComment(ctx *Ctx, slug string, userID int64) error {
 	dx := errors.D(ctx.Req, "articlesCreateComment")
 	var payload struct {
@@ -190,12 +346,74 @@ func articlesCreateComment(ctx *Ctx, slug string, userID int64) error {
 	if err != nil {
 		return errors.E(dx, err, http.StatusBadRequest)
 	}
+	if payload.Comment == nil {
+		return errors.E(dx, errors.Invalid, errors.Fields{"comment": {"can't be blank"}})
+	}
+	if fields := utils.Validate(&payload); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
 	comment := payload.Comment
 	comment.Author = userID
-	//TODO: validate inputs
 	json, err := ctx.Store().CreateComment(comment, slug)
 	if err != nil {
-		return errors.E(dx, err, http.StatusInternalServerError)
+		return errors.E(dx, err)
 	}
 	return utils.SendJSON(ctx.Res, http.StatusOK, json)
 }
+
+// Update Comment
+// PUT /api/articles/:slug/comments/:id
+// Example request body:
+// {
+//   "comment": {
+//     "body": "His name was my name too!"
+//   }
+// }
+// Authentication required, only the author can update a comment, returns the updated Comment
+// Required field: body; the previous body is kept in the comment's edit history
+func articlesUpdateComment(ctx *Ctx, slug string, commentID int64, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesUpdateComment")
+	var payload struct {
+		Comment *commentModel `json:"comment"`
+	}
+	err := utils.DecodeJSONBody(ctx.Res, ctx.Req, &payload)
+	if err != nil {
+		return errors.E(dx, err, http.StatusBadRequest)
+	}
+	if payload.Comment == nil {
+		return errors.E(dx, errors.Invalid, errors.Fields{"comment": {"can't be blank"}})
+	}
+	if fields := utils.Validate(&payload); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
+	json, err := ctx.Store().UpdateComment(slug, commentID, userID, payload.Comment.Body)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+}
+
+// Comment edit history
+// GET /api/articles/:slug/comments/:id/history
+// Authentication required, only moderators can read the history, returns the previous bodies of
+// the comment, most recent first:
+// {"history": [{"body": "...", "createdAt": "...", "replacedAt": "..."}]}
+func articlesCommentHistory(ctx *Ctx, slug string, commentID int64, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesCommentHistory")
+	json, err := ctx.Store().ListCommentHistoryJSON(slug, commentID, userID)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+}
+
+// Delete Comment
+// DELETE /api/articles/:slug/comments/:id
+// Authentication required, only the author can delete a comment
+func articlesDeleteComment(ctx *Ctx, slug string, commentID int64, userID int64) error {
+	dx := errors.D(ctx.Req, "articlesDeleteComment")
+	if err := ctx.Store().DeleteComment(slug, commentID, userID); err != nil {
+		return errors.E(dx, err)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, []byte("{}"))
+}
@@ -8,7 +8,9 @@ import (
 )
 
 // handles routes
-// POST /api/profiles/:username
+// GET /api/profiles/:username
+// POST /api/profiles/:username/follow
+// DELETE /api/profiles/:username/follow
 
 // ServeProfiles handles "/api/profiles/*"
 func ServeProfiles(ctx *Ctx) error {
@@ -21,20 +23,49 @@ func ServeProfiles(ctx *Ctx) error {
 	}
 	cmd, ctx.Req.URL.Path = utils.ShiftPath(ctx.Req.URL.Path)
 	switch cmd {
-	case "":
-		// GET /api/profiles/:username
-		json, err := ctx.Store().GetUserProfileJSON(userName)
-		if err != nil {
-			return errors.E(dx, err, http.StatusInternalServerError)
+	case "": // GET /api/profiles/:username
+		if dx.Method != "GET" {
+			return errors.E(dx, http.StatusMethodNotAllowed)
 		}
-		return utils.SendJSON(ctx.Res, http.StatusOK, json)
-	case "follow":
-		// handle follow
-		//	default:
+		return profilesGet(ctx, userName)
+	case "follow": // POST or DELETE /api/profiles/:username/follow
+		switch dx.Method {
+		case "POST", "DELETE":
+			if ctx.Authenticated(dx) {
+				return profilesFollow(ctx, userName, ctx.Session.UserID, dx.Method == "POST")
+			}
+		default:
+			return errors.E(dx, http.StatusMethodNotAllowed)
+		}
+	default:
+		return errors.E(dx, http.StatusNotFound)
+	}
+	return nil // error must have been handled by this point
+}
+
+// Get Profile
+// GET /api/profiles/:username
+// Authentication optional, returns a Profile
+func profilesGet(ctx *Ctx, userName string) error {
+	dx := errors.D(ctx.Req, "profilesGet")
+	json, err := ctx.Store().GetUserProfileJSON(userName, ctx.ViewerID())
+	if err != nil {
+		return errors.E(dx, err, http.StatusNotFound)
+	}
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+}
+
+// Follow user
+// POST /api/profiles/:username/follow
+// Unfollow user
+// DELETE /api/profiles/:username/follow
+// Authentication required, returns a Profile
+// No additional parameters required
+func profilesFollow(ctx *Ctx, userName string, userID int64, follow bool) error {
+	dx := errors.D(ctx.Req, "profilesFollow")
+	json, err := ctx.Store().FollowUser(userName, userID, follow)
+	if err != nil {
+		return errors.E(dx, err, http.StatusNotFound)
 	}
-	return errors.E(dx, http.StatusNotFound)
-	// if dx.Method == "POST" {
-	// 	return usersLogin(ctx)
-	// }
-	// return errors.E(dx, http.StatusMethodNotAllowed)
+	return utils.SendJSON(ctx.Res, http.StatusOK, json)
 }
@@ -11,22 +11,36 @@ import (
 // routes
 // GET /api/user
 // PUT /api/user
+// POST /api/user/refresh
+// GET /api/user/sessions
+// DELETE /api/user/sessions/:id
 
 // ServeUser handles "/api/user/*"
 func ServeUser(ctx *Ctx) error {
 	dx := errors.D(ctx.Req, "serveuser")
-	if dx.Path != "/" {
+	var head string
+	head, ctx.Req.URL.Path = utils.ShiftPath(dx.Path)
+	if !(head == "" || head == "refresh" && ctx.Req.URL.Path == "/" || head == "sessions") {
 		return errors.E(dx, http.StatusNotFound)
 	}
 	session, err := ctx.Server.Authenticate(ctx)
 	if err != nil {
 		return errors.E(dx, err, http.StatusUnauthorized)
 	}
+	switch head {
+	case "refresh":
+		if dx.Method == "POST" { // POST /api/user/refresh
+			return userRefresh(ctx, session)
+		}
+		return errors.E(dx, http.StatusMethodNotAllowed)
+	case "sessions":
+		return serveUserSessions(ctx, session)
+	}
 	switch dx.Method {
 	case "GET": // GET /api/user
 		return userGetCurrent(ctx, session)
 	case "PUT": // PUT /api/user
-		return userUpdate(ctx)
+		return userUpdate(ctx, session)
 	default:
 		return errors.E(dx, http.StatusMethodNotAllowed)
 	}
@@ -35,16 +49,161 @@ func ServeUser(ctx *Ctx) error {
 // GET /api/user
 // Authentication required, returns a User that's the current user
 func userGetCurrent(ctx *Ctx, s *sessions.Session) error {
-	dx := errors.D(ctx.Req, "getcurrent")
-	json, err := ctx.Store().GetUserJSON(s.UserID)
+	return sendUser(ctx, s, http.StatusOK)
+}
+
+// used to decode payload for user update; fields missing from the payload are nil and left unchanged.
+// An image of null removes the user's image
+type userUpdateModel struct {
+	User struct {
+		Email    *string          `json:"email" validate:"required,email,max=255"`
+		Username *string          `json:"username" validate:"required,max=32"`
+		Password *string          `json:"password" validate:"required,min=8,maxbytes=72"`
+		Bio      *string          `json:"bio" validate:"max=1000"`
+		Image    utils.NullString `json:"image" validate:"max=2048"`
+	} `json:"user"`
+}
+
+// PUT /api/user
+// Example request body:
+// {
+//   "user":{
+//     "email": "jake@jake.jake",
+//     "bio": "I like to skateboard",
+//     "image": "https://i.stack.imgur.com/xHWG8.jpg"
+//   }
+// }
+// Authentication required, returns the User
+// Accepted fields: email, username, password, image, bio
+// Changing the password logs out all other sessions of the user and replaces the current session
+// by a new one, so the returned token and cookie must be used from then on
+func userUpdate(ctx *Ctx, s *sessions.Session) error {
+	dx := errors.D(ctx.Req, "userUpdate")
+	var upd userUpdateModel
+	if err := utils.DecodeJSONBody(ctx.Res, ctx.Req, &upd); err != nil {
+		return errors.E(dx, err, http.StatusBadRequest)
+	}
+	if fields := utils.Validate(&upd); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
+	if err := ctx.Store().UpdateUser(s.UserID, &upd); err != nil {
+		return errors.E(dx, err)
+	}
+	if upd.User.Password != nil {
+		if _, err := ctx.Server.Sessions.DeleteUserSessions(s.UserID, s.ID); err != nil {
+			return errors.E(dx, err)
+		}
+		ns, err := ctx.Server.Sessions.Rotate(s, ctx.Req)
+		if err != nil {
+			return errors.E(dx, err)
+		}
+		setSessionCookie(ctx, ns)
+		s = ns
+	}
+	return sendUser(ctx, s, http.StatusOK)
+}
+
+// POST /api/user/refresh
+// Authentication required, returns the User with a new token and sets a new session cookie.
+// The old token and cookie no longer work
+func userRefresh(ctx *Ctx, s *sessions.Session) error {
+	dx := errors.D(ctx.Req, "userRefresh")
+	ns, err := ctx.Server.Sessions.Rotate(s, ctx.Req)
 	if err != nil {
+		return errors.E(dx, err)
+	}
+	setSessionCookie(ctx, ns)
+	return sendUser(ctx, ns, http.StatusOK)
+}
+
+// serveUserSessions handles "/api/user/sessions/*" for the user of session s
+func serveUserSessions(ctx *Ctx, s *sessions.Session) error {
+	dx := errors.D(ctx.Req, "serveUserSessions")
+	if dx.Path == "/" {
+		if dx.Method == "GET" { // GET /api/user/sessions
+			return userListSessions(ctx, s)
+		}
+		return errors.E(dx, http.StatusMethodNotAllowed)
+	}
+	id, tail := utils.ShiftPath(dx.Path)
+	if tail != "/" {
 		return errors.E(dx, http.StatusNotFound)
 	}
-	utils.SendJSON(ctx.Res, http.StatusFound, json)
-	return nil
+	if dx.Method == "DELETE" { // DELETE /api/user/sessions/:id
+		return userRevokeSession(ctx, s, id)
+	}
+	return errors.E(dx, http.StatusMethodNotAllowed)
+}
+
+// sessionTimeFormat matches the format of the dates returned by the other endpoints
+const sessionTimeFormat = "2006-01-02 15:04:05"
+
+// used to encode a session in the list of sessions; id is the session's public ID
+type sessionModel struct {
+	ID         string `json:"id"`
+	CreatedAt  string `json:"createdAt"`
+	LastActive string `json:"lastActive"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	Current    bool   `json:"current"`
 }
 
-func userUpdate(ctx *Ctx) error {
-	utils.Send(ctx.Res, []byte(`{"message": "userUpdate!"}`))
-	return nil
+// GET /api/user/sessions
+// Authentication required, returns the active sessions of the current user, most recently active first
+// Example response body:
+// {
+//   "sessions":[{
+//     "id": "pWbNyuI0V3bAzvCx",
+//     "createdAt": "2021-02-18 03:22:56",
+//     "lastActive": "2021-02-18 04:10:12",
+//     "userAgent": "Mozilla/5.0 ...",
+//     "ip": "192.0.2.1",
+//     "current": true
+//   }]
+// }
+func userListSessions(ctx *Ctx, s *sessions.Session) error {
+	dx := errors.D(ctx.Req, "userListSessions")
+	list, err := ctx.Server.Sessions.UserSessions(s.UserID)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	var resp struct {
+		Sessions []sessionModel `json:"sessions"`
+	}
+	resp.Sessions = make([]sessionModel, len(list))
+	for i, us := range list {
+		resp.Sessions[i] = sessionModel{
+			ID:         us.PublicID(),
+			CreatedAt:  us.CreatedAt.UTC().Format(sessionTimeFormat),
+			LastActive: us.LastActive.UTC().Format(sessionTimeFormat),
+			UserAgent:  us.UserAgent,
+			IP:         us.IP,
+			Current:    us.ID == s.ID,
+		}
+	}
+	return utils.JSON(ctx.Res, http.StatusOK, resp)
+}
+
+// DELETE /api/user/sessions/:id
+// Authentication required, ends the session of the current user with public ID id (as listed by
+// GET /api/user/sessions), eg one left open on a shared computer
+func userRevokeSession(ctx *Ctx, s *sessions.Session, id string) error {
+	dx := errors.D(ctx.Req, "userRevokeSession")
+	list, err := ctx.Server.Sessions.UserSessions(s.UserID)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	for _, us := range list {
+		if us.PublicID() == id {
+			if err := ctx.Server.Sessions.Delete(us.ID); err != nil {
+				return errors.E(dx, err)
+			}
+			if us.ID == s.ID {
+				http.SetCookie(ctx.Res, ctx.Server.Sessions.ExpiredCookie())
+			}
+			ctx.Res.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	return errors.E(dx, errors.NotFound, "no such session")
 }
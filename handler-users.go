@@ -4,11 +4,13 @@ import (
 	"net/http"
 
 	"github.com/drgo/realworld/errors"
+	"github.com/drgo/realworld/sessions"
 	"github.com/drgo/realworld/utils"
 )
 
 // handles routes
 // POST /api/users/login
+// POST /api/users/logout
 // POST /api/users
 
 type userModel struct {
@@ -20,12 +22,21 @@ type userModel struct {
 	Token    string  `json:"token"`
 }
 
-// used to decode payload for login and register
+// used to decode payload for register
 type credentials struct {
 	User struct {
-		Username string `json:"username"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Username string `json:"username" validate:"required,max=32"`
+		Email    string `json:"email" validate:"required,email,max=255"`
+		Password string `json:"password" validate:"required,min=8,maxbytes=72"` // bcrypt uses 72 bytes at most
+	} `json:"user"`
+}
+
+// used to decode payload for login
+type loginCredentials struct {
+	User struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+		Remember bool   `json:"remember"` // keep the user logged in across browser sessions
 	} `json:"user"`
 }
 
@@ -48,41 +59,69 @@ func ServeUsers(ctx *Ctx) error {
 		}
 		return errors.E(dx, http.StatusMethodNotAllowed)
 	}
+	// POST /api/users/logout
+	if head == "logout" {
+		if dx.Method == "POST" {
+			return usersLogout(ctx)
+		}
+		return errors.E(dx, http.StatusMethodNotAllowed)
+	}
 	return errors.E(dx, http.StatusNotFound)
 }
 
+// POST /api/users/logout
+// Authentication required, ends the current session and deletes the session cookie
+func usersLogout(ctx *Ctx) error {
+	dx := errors.D(ctx.Req, "logout")
+	s, err := ctx.Server.Authenticate(ctx)
+	if err != nil {
+		return errors.E(dx, err, http.StatusUnauthorized)
+	}
+	if err := ctx.Server.Sessions.Delete(s.ID); err != nil {
+		return errors.E(dx, err)
+	}
+	http.SetCookie(ctx.Res, ctx.Server.Sessions.ExpiredCookie())
+	ctx.Res.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
 // POST /api/users/login
 // Example request body:
 // {
 //   "user":{
 //     "email": "jake@jake.jake",
-//     "password": "jakejake"
+//     "password": "jakejake",
+//     "remember": true
 //   }
 // }
 // No authentication required, returns a User
 // Required fields: email, password
+// A remembered login gets a long-lived session and cookie
 func usersLogin(ctx *Ctx) error {
 	dx := errors.D(ctx.Req, "login")
-	var creds credentials
+	var creds loginCredentials
 	if err := utils.DecodeJSONBody(ctx.Res, ctx.Req, &creds); err != nil {
 		return errors.E(dx, err, http.StatusBadRequest)
 	}
+	if fields := utils.Validate(&creds); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
 	_ = errors.Debug && errors.Logln("creds:", creds)
-	row, err := ctx.Store().SignInByEmailAndPassword(creds.User.Email, creds.User.Password)
+	user, err := ctx.Store().SignInByEmailAndPassword(creds.User.Email, creds.User.Password)
 	if err != nil {
 		return errors.E(dx, err, http.StatusUnauthorized)
 	}
-	// create session token to store this user id
-	s := ctx.Server.Sessions.Add(row["id"].(int64))
-	// send token as cookie
-	c := s.NewCookie()
-	_ = errors.Debug && errors.Logln("cookie", c)
-	http.SetCookie(ctx.Res, c)
-	json, err := ctx.Store().GetUserJSON(s.UserID)
+	// a session the client already holds is replaced by a new one rather than reused
+	if old, err := ctx.Server.Authenticate(ctx); err == nil {
+		if err := ctx.Server.Sessions.Delete(old.ID); err != nil {
+			return errors.E(dx, err)
+		}
+	}
+	s, err := startSession(ctx, user.ID, creds.User.Remember)
 	if err != nil {
-		return errors.E(dx, http.StatusNotFound)
+		return errors.E(dx, err)
 	}
-	return utils.SendJSON(ctx.Res, http.StatusOK, json)
+	return sendUser(ctx, s, http.StatusOK)
 }
 
 // POST /api/users
@@ -102,10 +141,50 @@ func usersRegister(ctx *Ctx) error {
 	if err := utils.DecodeJSONBody(ctx.Res, ctx.Req, &creds); err != nil {
 		return errors.E(dx, err, http.StatusBadRequest)
 	}
+	if fields := utils.Validate(&creds); fields != nil {
+		return errors.E(dx, errors.Invalid, fields)
+	}
 	id, err := ctx.Store().CreateUser(&creds)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	s, err := startSession(ctx, id, false)
+	if err != nil {
+		return errors.E(dx, err)
+	}
+	return sendUser(ctx, s, http.StatusCreated)
+}
+
+// startSession creates a session, remembered if remember is true, for user uid and sends its ID
+// as a cookie
+func startSession(ctx *Ctx, uid int64, remember bool) (*sessions.Session, error) {
+	// create session token to store this user id
+	s, err := ctx.Server.Sessions.Add(uid, remember, ctx.Req)
+	if err != nil {
+		return nil, err
+	}
+	setSessionCookie(ctx, s)
+	return s, nil
+}
+
+// setSessionCookie sends the ID of session s as a cookie
+func setSessionCookie(ctx *Ctx, s *sessions.Session) {
+	c := s.NewCookie()
+	_ = errors.Debug && errors.Logln("cookie", c)
+	http.SetCookie(ctx.Res, c)
+}
+
+// sendUser sends the user of session s with a token that identifies the session
+// in the Authorization header of subsequent requests
+func sendUser(ctx *Ctx, s *sessions.Session, status int) error {
+	dx := errors.D(ctx.Req, "sendUser")
+	token, err := s.Token()
 	if err != nil {
 		return errors.E(dx, err, http.StatusInternalServerError)
 	}
-	json, err := ctx.Store().GetUserJSON(id)
-	return utils.SendJSON(ctx.Res, http.StatusFound, json)
+	json, err := ctx.Store().GetUserJSON(s.UserID, token)
+	if err != nil {
+		return errors.E(dx, err, http.StatusNotFound)
+	}
+	return utils.SendJSON(ctx.Res, status, json)
 }
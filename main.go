@@ -6,6 +6,7 @@ import (
 	_ "net/http/pprof" // for profiling
 	"os"
 	"runtime/pprof"
+	"time"
 
 	"github.com/drgo/realworld/errors"
 	// _ "github.com/ianlancetaylor/cgosymbolizer" 	//does not work on macOS
@@ -17,7 +18,7 @@ const (
 	apiVersion  = "v1"
 	apiRoot     = "api"
 	cookieName  = "session"
-	maxLifeTime = 10 * 60 //10mins
+	maxLifeTime = 24 * 60 * 60 //1 day since last activity
 
 	versionMessage = "%s %s (%s). CopyRight 2018-2021 Salah Mahmud"
 )
@@ -37,12 +38,36 @@ func getVersion() string {
 var (
 	debug      = flag.Bool("debug", false, "turn on debugging mode")
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	dbName     = flag.String("db", "db/rw.db", "path of the database, created if it does not exist")
+	qTimeout   = flag.Duration("query-timeout", 5*time.Second, "maximum time of a database query; 0 for no limit")
+	cacheSess  = flag.Bool("session-cache", true, "cache sessions in memory; disable if other servers share the database")
 )
 
+const usage = `Usage: %[1]s [flags]                   runs the server
+       %[1]s [flags] migrate status    lists the database migrations
+       %[1]s [flags] migrate up [v]    migrates the database up to version v (default is the latest)
+       %[1]s [flags] migrate down [v]  migrates the database down to version v (default is the previous)
+Flags:
+`
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, exeName)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	fmt.Println(getVersion())
 	errors.Debug = *debug
+	if flag.Arg(0) == "migrate" {
+		if err := migrateCommand(os.Stdout, *dbName, flag.Args()[1:]); err != nil {
+			errors.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -54,7 +79,9 @@ func main() {
 	opts := ServerOptions{
 		CookieName:   cookieName,
 		MaxLifeTime:  maxLifeTime,
-		DatabaseName: "db/rw.db",
+		DatabaseName: *dbName,
+		QueryTimeout: *qTimeout,
+		SessionCache: *cacheSess,
 		// use "localhost:8080" to suppress macos firewall permission
 		Addr: host + ":" + port,
 	}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sql "crawshaw.io/sqlite"
+	sqlx "crawshaw.io/sqlite/sqlitex"
+	"github.com/drgo/realworld/errors"
+)
+
+// migrationFiles holds the schema migrations as pairs of scripts named NNNN_name.up.sql, which applies
+// migration number NNNN, and NNNN_name.down.sql, which reverts it
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a numbered schema change
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations returns the embedded migrations sorted by version
+func loadMigrations() ([]*migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		i := strings.IndexByte(base, '_')
+		if i < 0 || (!strings.HasSuffix(base, ".up") && !strings.HasSuffix(base, ".down")) {
+			return nil, errors.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, err := strconv.Atoi(base[:i])
+		if err != nil || version <= 0 {
+			return nil, errors.Errorf("invalid migration version: %s", entry.Name())
+		}
+		script, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{Version: version}
+			byVersion[version] = m
+		}
+		if strings.HasSuffix(base, ".up") {
+			m.Name, m.Up = strings.TrimSuffix(base[i+1:], ".up"), string(script)
+		} else {
+			m.Down = string(script)
+		}
+	}
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %d needs both an up and a down script", m.Version)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// initMigrations creates the schema_migrations table that records the applied migrations.
+// Databases created by the scripts that predate migrations (they have a User table but no
+// schema_migrations table) are recorded as being at version 1 if they have all the tables and
+// columns created by migration 1; other databases are refused
+func (db *sqlite) initMigrations() error {
+	return db.Tx(func(tx *Tx) error {
+		var rows []struct{ Name string }
+		if _, err := tx.Scan(`SELECT name FROM sqlite_master WHERE type='table' AND
+		name IN ('schema_migrations', 'User')`, nil, &rows); err != nil {
+			return err
+		}
+		tables := map[string]bool{}
+		for _, row := range rows {
+			tables[row.Name] = true
+		}
+		if tables["schema_migrations"] {
+			return nil
+		}
+		if tables["User"] {
+			if err := checkInitialSchema(tx); err != nil {
+				return err
+			}
+		}
+		if _, _, err := tx.Exec(`CREATE TABLE schema_migrations
+		(
+		  version             INTEGER PRIMARY KEY,
+		  name                TEXT NOT NULL,
+		  appliedAt           INTEGER NOT NULL default (strftime('%s','now'))
+		)`, nil); err != nil {
+			return err
+		}
+		if !tables["User"] {
+			return nil
+		}
+		_, _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (1, 'initial')", nil)
+		return err
+	})
+}
+
+// tableColumnsQuery lists the columns of all tables as (tbl, col) rows
+const tableColumnsQuery = `SELECT m.name AS tbl, p.name AS col FROM sqlite_master m,
+pragma_table_info(m.name) p WHERE m.type='table' ORDER BY m.name, p.cid`
+
+type tableColumn struct{ Tbl, Col string }
+
+// checkInitialSchema returns an error listing the tables and columns created by migration 1 that are
+// missing from the database of tx. The expected schema is read from an in-memory database
+// created by the migration itself
+func checkInitialSchema(tx *Tx) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		return errors.Errorf("migration 1 not found")
+	}
+	conn, err := sql.OpenConn(":memory:", 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := sqlx.ExecScript(conn, migrations[0].Up); err != nil {
+		return err
+	}
+	var want, got []tableColumn
+	if _, err := connScan(conn, tableColumnsQuery, nil, &want); err != nil {
+		return err
+	}
+	if _, err := tx.Scan(tableColumnsQuery, nil, &got); err != nil {
+		return err
+	}
+	have := map[tableColumn]bool{}
+	for _, c := range got {
+		have[c], have[tableColumn{Tbl: c.Tbl}] = true, true
+	}
+	var missing []string
+	for _, c := range want {
+		switch {
+		case !have[tableColumn{Tbl: c.Tbl}]:
+			if len(missing) == 0 || missing[len(missing)-1] != c.Tbl {
+				missing = append(missing, c.Tbl)
+			}
+		case !have[c]:
+			missing = append(missing, c.Tbl+"."+c.Col)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("the database has no schema_migrations table and does not match "+
+			"migration %04d_%s, missing: %s", migrations[0].Version, migrations[0].Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration or 0 if there is none
+func (db *sqlite) SchemaVersion() (int, error) {
+	if err := db.initMigrations(); err != nil {
+		return 0, err
+	}
+	var v struct{ Version int }
+	if _, err := db.Scan("SELECT COALESCE(MAX(version), 0) AS version FROM schema_migrations", nil, &v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+// Migrate applies or reverts migrations until the schema is at version target; a negative target
+// means the latest version and 0 reverts all migrations. Each migration runs in a transaction
+// that also updates schema_migrations so that a failing migration leaves the schema unchanged
+func (db *sqlite) Migrate(target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if target < 0 && len(migrations) > 0 {
+		target = migrations[len(migrations)-1].Version
+	}
+	if target > 0 && sort.Search(len(migrations), func(i int) bool {
+		return migrations[i].Version >= target
+	}) == len(migrations) {
+		return errors.Errorf("no such migration: %d", target)
+	}
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		err := db.Tx(func(tx *Tx) error {
+			if err := tx.refreshSchema(); err != nil {
+				return err
+			}
+			if err := tx.ExecScript(m.Up); err != nil {
+				return err
+			}
+			_, _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($version, $name)",
+				Args{"$version": m.Version, "$name": m.Name})
+			return err
+		})
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("error applying migration %04d_%s", m.Version, m.Name))
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		err := db.Tx(func(tx *Tx) error {
+			if err := tx.refreshSchema(); err != nil {
+				return err
+			}
+			if err := tx.ExecScript(m.Down); err != nil {
+				return err
+			}
+			_, _, err := tx.Exec("DELETE FROM schema_migrations WHERE version=$version",
+				Args{"$version": m.Version})
+			return err
+		})
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("error reverting migration %04d_%s", m.Version, m.Name))
+		}
+	}
+	return nil
+}
+
+// refreshSchema makes sure that the connection used by tx knows about schema changes made by other
+// connections in the pool. SQLite checks statements like CREATE TABLE against the schema cached by the
+// connection when they are prepared, which is only reloaded once a statement reads the database
+func (tx *Tx) refreshSchema() error {
+	_, _, err := tx.Query("SELECT COUNT(*) FROM sqlite_master", nil)
+	return err
+}
+
+// migrationStatus describes a migration and when it was applied (zero if it is pending)
+type migrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus returns the status of all known migrations
+func (db *sqlite) MigrationStatus() ([]migrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.initMigrations(); err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Version   int
+		AppliedAt int64
+	}
+	if _, err := db.Scan("SELECT version, appliedAt FROM schema_migrations", nil, &rows); err != nil {
+		return nil, err
+	}
+	applied := map[int]int64{}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	status := make([]migrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i] = migrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			status[i].AppliedAt = time.Unix(at, 0)
+		}
+	}
+	return status, nil
+}
+
+// migrateCommand runs the migrate command on database dsn:
+//
+//	migrate status            lists the migrations and when they were applied
+//	migrate up [version]      applies migrations up to version (default is the latest)
+//	migrate down [version]    reverts migrations down to version (default is the previous one)
+func migrateCommand(w io.Writer, dsn string, args []string) error {
+	db, err := NewDB(dsn, DefaultPoolFlags, DefaultPoolSize)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+	target := -1
+	if len(args) > 1 {
+		if target, err = strconv.Atoi(args[1]); err != nil || target < 0 {
+			return errors.Errorf("invalid migration version: %s", args[1])
+		}
+	}
+	switch args[0] {
+	case "status":
+	case "up":
+		err = db.Migrate(target)
+	case "down":
+		if target < 0 {
+			if target, err = db.previousVersion(); err != nil {
+				return err
+			}
+		}
+		err = db.Migrate(target)
+	default:
+		return errors.Errorf("unknown migrate command: %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	status, err := db.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%04d_%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
+
+// previousVersion returns the version that precedes the current schema version (0 if none)
+func (db *sqlite) previousVersion() (int, error) {
+	if err := db.initMigrations(); err != nil {
+		return 0, err
+	}
+	var v struct{ Version int }
+	if _, err := db.Scan(`SELECT COALESCE((SELECT version FROM schema_migrations ORDER BY version DESC
+	LIMIT 1 OFFSET 1), 0) AS version`, nil, &v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "rw.db"), DefaultPoolFlags, DefaultPoolSize)
+	check(t, err)
+	defer db.Close()
+	migrations, err := loadMigrations()
+	check(t, err)
+	latest := migrations[len(migrations)-1].Version
+	tableCount := func() int64 {
+		rows, _, err := db.Query(`SELECT COUNT(*) AS n FROM sqlite_master WHERE type='table'
+		AND name<>'schema_migrations'`, nil)
+		check(t, err)
+		return rows[0]["n"].(int64)
+	}
+	for _, tt := range []struct {
+		target, want int
+	}{{-1, latest}, {0, 0}, {latest, latest}, {-1, latest}} {
+		check(t, db.Migrate(tt.target))
+		version, err := db.SchemaVersion()
+		check(t, err)
+		if version != tt.want {
+			t.Errorf("Migrate(%d): got version %d, want %d", tt.target, version, tt.want)
+		}
+		if n := tableCount(); (n == 0) != (tt.want == 0) {
+			t.Errorf("Migrate(%d): got %d tables", tt.target, n)
+		}
+	}
+	status, err := db.MigrationStatus()
+	check(t, err)
+	for _, s := range status {
+		if s.AppliedAt.IsZero() {
+			t.Errorf("migration %d is pending", s.Version)
+		}
+	}
+	if err := db.Migrate(latest + 1); err == nil {
+		t.Errorf("Migrate(%d): want error for unknown version", latest+1)
+	}
+}
+
+func TestMigrateAdoptsExistingDatabase(t *testing.T) {
+	migrations, err := loadMigrations()
+	check(t, err)
+	for _, tt := range []struct {
+		name, script, wantErr string
+	}{
+		// created by the scripts that predate migrations
+		{"initial schema", migrations[0].Up, ""},
+		{"missing tables", "CREATE TABLE User (id INTEGER PRIMARY KEY)",
+			"missing: Article, Comment, CommentHistory, Favourite, Follow, SlugHistory, Tag, User.email, .*User.moderator$"},
+		{"missing column", strings.NewReplacer("moderator            NUMERIC NOT NULL DEFAULT 0,", "",
+			",\n  CONSTRAINT User_ck_moderator CHECK (moderator IN (0, 1))", "").Replace(migrations[0].Up),
+			"missing: User.moderator$"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := NewDB(filepath.Join(t.TempDir(), "rw.db"), DefaultPoolFlags, DefaultPoolSize)
+			check(t, err)
+			defer db.Close()
+			check(t, db.Tx(func(tx *Tx) error { return tx.ExecScript(tt.script) }))
+			version, err := db.SchemaVersion()
+			if tt.wantErr == "" {
+				check(t, err)
+				if version != 1 {
+					t.Errorf("got version %d, want 1", version)
+				}
+				return
+			}
+			if err == nil || !regexMatch(tt.wantErr, err.Error()) {
+				t.Fatalf("got error %v, want %s", err, tt.wantErr)
+			}
+			// the database is left unchanged
+			var rows []struct{ Name string }
+			_, err = db.Scan("SELECT name FROM sqlite_master WHERE name='schema_migrations'", nil, &rows)
+			check(t, err)
+			if len(rows) != 0 {
+				t.Errorf("want no schema_migrations table")
+			}
+		})
+	}
+}
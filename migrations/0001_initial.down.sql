@@ -0,0 +1,10 @@
+-- ArticleList is an unused view created by the scripts that predate migrations
+DROP VIEW IF EXISTS ArticleList;
+DROP TABLE CommentHistory;
+DROP TABLE Comment;
+DROP TABLE Favourite;
+DROP TABLE Tag;
+DROP TABLE SlugHistory;
+DROP TABLE Article;
+DROP TABLE Follow;
+DROP TABLE User;
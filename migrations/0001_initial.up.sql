@@ -0,0 +1,98 @@
+-- sqlite does not have a date/time type. so using INTEGER and entering Unix time which
+-- is likely efficient for storage (4 bytes) and for sorting and finding ranges
+-- apps should use int64 to store and retrive dates
+-- In SQLite, INTEGER PRIMARY KEY column is auto-incremented and becomes the rowid
+CREATE TABLE User
+(
+  id                   INTEGER PRIMARY KEY,
+  email                TEXT NOT NULL UNIQUE,
+  emailConfirmed       NUMERIC NOT NULL DEFAULT 0,
+  password             TEXT,
+  username             TEXT NOT NULL UNIQUE,
+  bio                  TEXT NOT NULL DEFAULT "",
+  image                TEXT,
+  accessFailedCount    INTEGER NOT NULL DEFAULT 0,
+  -- moderators can read the edit history of comments
+  moderator            NUMERIC NOT NULL DEFAULT 0,
+  CONSTRAINT User_ck_emailConfirmed CHECK (emailConfirmed IN (0, 1)),
+  CONSTRAINT User_ck_moderator CHECK (moderator IN (0, 1))
+);
+CREATE INDEX User_ix_email ON User (email);
+
+CREATE TABLE Follow
+(
+  userID              INTEGER NOT NULL,
+  followingID         INTEGER NOT NULL,
+  PRIMARY KEY (userID,followingID)
+);
+
+CREATE TABLE Article
+(
+  id                  INTEGER PRIMARY KEY,
+  author              INTEGER NOT NULL,
+  slug                TEXT NOT NULL,
+  title               TEXT NOT NULL DEFAULT "Please, enter article title",
+  description         TEXT,
+  body                TEXT NOT NULL DEFAULT "Please, complete your article",
+  favourited          NUMERIC NOT NULL DEFAULT 0,
+  favouritesCount     NUMERIC NOT NULL DEFAULT 0,
+  createdAt           INTEGER NOT NULL default (strftime('%s','now')),
+  updatedAt           INTEGER NOT NULL default (strftime('%s','now')),
+  CONSTRAINT favourited CHECK (favourited IN (0, 1))
+);
+CREATE TRIGGER Article_tr_update After Update On Article Begin
+  Update Article Set
+    updatedAt = strftime('%s', DateTime('Now', 'localtime'))
+  Where id = new.id;
+End;
+CREATE INDEX Artice_ix_author ON Article (author);
+CREATE UNIQUE INDEX Article_ix_slug ON Article (slug);
+
+-- previous slugs of articles whose title has changed, used to redirect old links
+CREATE TABLE SlugHistory
+(
+  slug                TEXT PRIMARY KEY,
+  articleID           INTEGER NOT NULL
+);
+CREATE INDEX SlugHistory_ix_articleID ON SlugHistory (articleID);
+
+CREATE TABLE Tag
+(
+  tag                 TEXT NOT NULL,
+  articleID           INTEGER NOT NULL,
+  PRIMARY KEY (tag,articleID)
+);
+CREATE INDEX Tag_ix_tag ON Tag (tag);
+CREATE INDEX Tag_ix_articleID ON Tag (articleID);
+
+CREATE TABLE Favourite
+(
+  userID              INTEGER NOT NULL,
+  articleID           INTEGER NOT NULL,
+  PRIMARY KEY (userID,articleID)
+);
+
+CREATE TABLE Comment
+(
+  id                 INTEGER PRIMARY KEY,
+  author             INTEGER NOT NULL,
+  articleID          INTEGER NOT NULL,
+  body               TEXT NOT NULL DEFAULT "Please, complete your comment",
+  createdAt          INTEGER NOT NULL default (strftime('%s','now')),
+  updatedAt          INTEGER NOT NULL default (strftime('%s','now')),
+  -- comment this comment replies to; NULL for top-level comments
+  parentID           INTEGER
+);
+CREATE INDEX Comment_ix_parentID ON Comment (parentID);
+
+-- previous bodies of edited comments
+CREATE TABLE CommentHistory
+(
+  id                 INTEGER PRIMARY KEY,
+  commentID          INTEGER NOT NULL,
+  body               TEXT NOT NULL,
+  -- when this body was written and when it was replaced by an edit
+  createdAt          INTEGER NOT NULL,
+  replacedAt         INTEGER NOT NULL default (strftime('%s','now'))
+);
+CREATE INDEX CommentHistory_ix_commentID ON CommentHistory (commentID);
@@ -0,0 +1,10 @@
+-- sessions survive restarts; times are Unix time as in the other tables
+CREATE TABLE Session
+(
+  id                  TEXT PRIMARY KEY,
+  userID              INTEGER NOT NULL,
+  createdAt           INTEGER NOT NULL,
+  lastActive          INTEGER NOT NULL
+);
+CREATE INDEX Session_ix_userID ON Session (userID);
+CREATE INDEX Session_ix_lastActive ON Session (lastActive);
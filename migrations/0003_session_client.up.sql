@@ -0,0 +1,3 @@
+-- the client that started each session, shown to users listing their sessions
+ALTER TABLE Session ADD COLUMN userAgent TEXT NOT NULL DEFAULT '';
+ALTER TABLE Session ADD COLUMN ip TEXT NOT NULL DEFAULT '';
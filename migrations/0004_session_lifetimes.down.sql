@@ -0,0 +1,15 @@
+-- sqlite cannot drop columns so the table is rebuilt without them
+CREATE TABLE Session_old
+(
+  id                  TEXT PRIMARY KEY,
+  userID              INTEGER NOT NULL,
+  createdAt           INTEGER NOT NULL,
+  lastActive          INTEGER NOT NULL,
+  userAgent           TEXT NOT NULL DEFAULT '',
+  ip                  TEXT NOT NULL DEFAULT ''
+);
+INSERT INTO Session_old SELECT id, userID, createdAt, lastActive, userAgent, ip FROM Session;
+DROP TABLE Session;
+ALTER TABLE Session_old RENAME TO Session;
+CREATE INDEX Session_ix_userID ON Session (userID);
+CREATE INDEX Session_ix_lastActive ON Session (lastActive);
@@ -0,0 +1,12 @@
+-- idle timeout (seconds) and absolute expiry of each session, and whether it was remembered.
+-- Existing sessions get the defaults of sessions that are not remembered
+ALTER TABLE Session ADD COLUMN idleTimeout INTEGER NOT NULL DEFAULT 86400;
+ALTER TABLE Session ADD COLUMN expiresAt INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE Session ADD COLUMN remember NUMERIC NOT NULL DEFAULT 0;
+ALTER TABLE Session ADD COLUMN userStamp TEXT NOT NULL DEFAULT '';
+-- when the session may be pruned; it replaces lastActive as the pruning index
+ALTER TABLE Session ADD COLUMN pruneAt INTEGER NOT NULL DEFAULT 0;
+UPDATE Session SET expiresAt = createdAt + 7 * 24 * 60 * 60;
+UPDATE Session SET pruneAt = min(expiresAt, lastActive + idleTimeout + idleTimeout / 10);
+DROP INDEX Session_ix_lastActive;
+CREATE INDEX Session_ix_pruneAt ON Session (pruneAt);
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestFollow(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	registerTestUser(t, s, "celeb")
+	var resp struct {
+		Profile struct {
+			Username  string
+			Following bool
+		}
+	}
+	for _, tt := range []struct {
+		method    string
+		following bool
+	}{
+		{"POST", true},
+		{"POST", true}, // following twice is not an error
+		{"DELETE", false},
+		{"DELETE", false},
+	} {
+		rec := serveAs(t, s, jake, tt.method, "/api/profiles/celeb/follow", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s follow: got %v %s", tt.method, rec.Code, rec.Body)
+		}
+		decodeTest(t, rec, &resp)
+		if resp.Profile.Username != "celeb" || resp.Profile.Following != tt.following {
+			t.Errorf("%s follow: got %s", tt.method, rec.Body)
+		}
+		// the profile as seen by the follower agrees
+		decodeTest(t, serveAs(t, s, jake, "GET", "/api/profiles/celeb", ""), &resp)
+		if resp.Profile.Following != tt.following {
+			t.Errorf("%s follow: profile has following=%v", tt.method, resp.Profile.Following)
+		}
+	}
+	if rec := serveAs(t, s, jake, "POST", "/api/profiles/jake/follow", ""); rec.Code != http.StatusOK ||
+		regexMatch(`"following":true`, rec.Body.String()) {
+		t.Errorf("following oneself: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, jake, "POST", "/api/profiles/nobody/follow", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("following unknown user: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+	if rec := serveAs(t, s, nil, "POST", "/api/profiles/celeb/follow", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("following without authentication: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
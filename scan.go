@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	sql "crawshaw.io/sqlite"
+	"github.com/drgo/realworld/errors"
+)
+
+// Scan runs query and stores its result in dest, which must be a pointer to a struct (filled from
+// the first row, if any) or a pointer to a slice of structs or of pointers to structs (one element
+// per row). Columns are matched to struct fields by the field's `db` tag or, if it has none, by its
+// name ignoring case; fields of embedded structs are matched as if they were fields of dest.
+// A NULL sets a pointer field to nil and any other field to its zero value.
+// Unlike Query, Scan does not allocate a map per row and reports type mismatches as errors
+func (db *sqlite) Scan(query string, args Args, dest interface{}) (rowCount int, err error) {
+	err = db.withConn(db.pool, func(conn *sql.Conn) error {
+		rowCount, err = connScan(conn, query, args, dest)
+		return err
+	})
+	return rowCount, err
+}
+
+// Scan is like sqlite.Scan but runs query within the transaction
+func (tx *Tx) Scan(query string, args Args, dest interface{}) (rowCount int, err error) {
+	return connScan(tx.conn, query, args, dest)
+}
+
+func connScan(conn *sql.Conn, query string, args Args, dest interface{}) (rowCount int, err error) {
+	_ = errors.Debug && errors.Logln("Scan:", query)
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return 0, errors.Errorf("Scan: dest must be a non-nil pointer, got %T", dest)
+	}
+	v = v.Elem()
+	var (
+		slice    reflect.Value // the slice pointed to by dest, if any
+		elemType reflect.Type  // the struct type of each row
+		elemPtr  bool          // whether slice elements are pointers to structs
+	)
+	switch {
+	case v.Kind() == reflect.Struct:
+		elemType = v.Type()
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		slice, elemType = v, v.Type().Elem()
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Ptr &&
+		v.Type().Elem().Elem().Kind() == reflect.Struct:
+		slice, elemType, elemPtr = v, v.Type().Elem().Elem(), true
+	default:
+		return 0, errors.Errorf("Scan: dest must point to a struct or a slice of structs, got %T", dest)
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	if err := bindQuery(stmt, args); err != nil {
+		return 0, err
+	}
+	defer resetStmt(stmt, &err)
+	fields := fieldsOf(elemType)
+	// map each column to the index of its field
+	cols := make([][]int, stmt.ColumnCount())
+	for i := range cols {
+		name := stmt.ColumnName(i)
+		index, ok := fields[strings.ToLower(name)]
+		if !ok {
+			return 0, errors.Errorf("Scan: column %s has no matching field in %s", name, elemType)
+		}
+		cols[i] = index
+	}
+	if slice.IsValid() {
+		slice.SetLen(0)
+	}
+	for {
+		if hasRow, err := stmt.Step(); err != nil {
+			return 0, err
+		} else if !hasRow {
+			break
+		}
+		rowCount++
+		row := v
+		if slice.IsValid() {
+			row = reflect.New(elemType).Elem()
+		} else if rowCount > 1 {
+			continue // a struct holds the first row only; step through the rest to complete the query
+		}
+		for i, index := range cols {
+			if err := scanColumn(stmt, i, row.FieldByIndex(index)); err != nil {
+				return 0, err
+			}
+		}
+		if slice.IsValid() {
+			if elemPtr {
+				row = row.Addr()
+			}
+			slice.Set(reflect.Append(slice, row))
+		}
+	}
+	return rowCount, nil
+}
+
+// scanColumn stores column col of the current row of stmt in field f
+func scanColumn(stmt *sql.Stmt, col int, f reflect.Value) error {
+	if f.Kind() == reflect.Ptr {
+		if stmt.ColumnType(col) == sql.SQLITE_NULL {
+			f.Set(reflect.Zero(f.Type()))
+			return nil
+		}
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+	switch f.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f.SetInt(stmt.ColumnInt64(col))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f.SetUint(uint64(stmt.ColumnInt64(col)))
+	case reflect.Float32, reflect.Float64:
+		f.SetFloat(stmt.ColumnFloat(col))
+	case reflect.Bool:
+		f.SetBool(stmt.ColumnInt64(col) != 0)
+	case reflect.String:
+		f.SetString(stmt.ColumnText(col))
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.Uint8 {
+			return errors.Errorf("Scan: cannot scan column %s into a field of type %s", stmt.ColumnName(col), f.Type())
+		}
+		var b []byte
+		if stmt.ColumnType(col) != sql.SQLITE_NULL {
+			b = make([]byte, stmt.ColumnLen(col))
+			stmt.ColumnBytes(col, b)
+		}
+		f.SetBytes(b)
+	default:
+		return errors.Errorf("Scan: cannot scan column %s into a field of type %s", stmt.ColumnName(col), f.Type())
+	}
+	return nil
+}
+
+// fieldIndexes caches the result of fieldsOf for each struct type
+var fieldIndexes sync.Map // map[reflect.Type]map[string][]int
+
+// fieldsOf returns the index of each exported field of struct type t keyed by the lowercase column
+// name it is scanned from. Fields tagged `db:"-"` are skipped
+func fieldsOf(t reflect.Type) map[string][]int {
+	if fields, ok := fieldIndexes.Load(t); ok {
+		return fields.(map[string][]int)
+	}
+	fields := map[string][]int{}
+	var walk func(t reflect.Type, parent []int)
+	walk = func(t reflect.Type, parent []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			index := append(append([]int{}, parent...), i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				walk(f.Type, index)
+				continue
+			}
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := f.Tag.Get("db")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			// fields of the outer struct take precedence over those of embedded structs
+			if _, ok := fields[strings.ToLower(name)]; !ok || len(index) < len(fields[strings.ToLower(name)]) {
+				fields[strings.ToLower(name)] = index
+			}
+		}
+	}
+	walk(t, nil)
+	fieldIndexes.Store(t, fields)
+	return fields
+}
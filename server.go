@@ -17,6 +17,9 @@ type ServerOptions struct {
 	MaxLifeTime  int
 	DatabaseName string
 	Addr         string
+	QueryTimeout time.Duration
+	// SessionCache keeps sessions in memory as well as in the database
+	SessionCache bool
 }
 
 type server struct {
@@ -27,9 +30,10 @@ type server struct {
 }
 
 func NewServer(opts *ServerOptions) *server {
+	store := mustNewStore(opts.DatabaseName, opts.QueryTimeout)
 	s := &server{
-		Store:    mustNewStore(opts.DatabaseName),
-		Sessions: sessions.NewSessionManager(opts.CookieName, opts.MaxLifeTime),
+		Store:    store,
+		Sessions: sessions.NewSessionManager(opts.CookieName, opts.MaxLifeTime, store.SessionBackend(), opts.SessionCache),
 		srv: &http.Server{
 			Addr: opts.Addr,
 			// Handler: http.NewServeMux(),
@@ -40,6 +44,8 @@ func NewServer(opts *ServerOptions) *server {
 			// IdleTimeout:  15 * time.Second,
 		},
 	}
+	// remembered sessions end when the user's password changes
+	s.Sessions.UserStamp = store.UserStamp
 	// replace srv.Handler.HandleFunc... if s.sev.Handler is initialized
 	http.HandleFunc("/", s.ServeHTTP)
 	return s
@@ -84,24 +90,34 @@ func (s *server) Start() {
 // 		"can't be empty"
 // 	  ]
 // 	}
+// errors carrying field-level errors are reported per field instead
+// 	"errors":{
+// 	  "email": [
+// 		"has already been taken"
+// 	  ]
+// 	}
 func (s *server) Error(w http.ResponseWriter, err error) {
 	var rwErr struct {
-		Errors struct {
-			Body []string `json:"body"`
-		} `json:"errors"`
+		Errors errors.Fields `json:"errors"`
 	}
 	status := http.StatusInternalServerError //default error code
 	e, ok := err.(*errors.Error)
 	if ok {
-		rwErr.Errors.Body = append(rwErr.Errors.Body, e.Error())
-		status = e.Status
-	} else {
-		//not an errors.Error
-		rwErr.Errors.Body = append(rwErr.Errors.Body, err.Error())
+		if e.Status != 0 {
+			status = e.Status
+		}
+		// an interrupted query is reported as such whatever status the handler chose
+		if errors.Is(errors.Timeout, e) || errors.Is(errors.Unavailable, e) {
+			status = e.Kind.Status()
+		}
+		rwErr.Errors = errors.FieldsOf(e)
+	}
+	if len(rwErr.Errors) == 0 {
+		rwErr.Errors = errors.Fields{"body": {err.Error()}}
 	}
 	utils.JSON(w, status, rwErr)
 	// for the moment,log the error here
-	_ = errors.Debug && errors.Logln(rwErr.Errors.Body)
+	_ = errors.Debug && errors.Logln(rwErr.Errors)
 }
 
 // func (s *server) NewContext(w http.ResponseWriter, r *http.Request) *Ctx {
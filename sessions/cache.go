@@ -0,0 +1,191 @@
+package sessions
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shardCount is the number of independently locked parts of the cache. Requests for sessions
+// in different shards never wait for each other
+const shardCount = 32
+
+// entry is a cached session
+type entry struct {
+	// lastActive is the time the session was last used, in Unix nanoseconds. It is updated
+	// atomically on every request so that requests only need a read lock on the shard
+	lastActive int64
+	// saved is lastActive as last saved to the backend, in Unix nanoseconds (atomic)
+	saved int64
+	// validated is when a remembered session was last checked against the user record, in Unix
+	// nanoseconds (atomic). Sessions are validated before they are cached
+	validated int64
+	// s is shared by all requests of the session and never changed once cached;
+	// s.LastActive holds the time the session was cached
+	s *Session
+	// deadline is the expiry time (Unix nanoseconds) by which the entry is ordered in the expiry
+	// heap. It is set when the entry is pushed and lags behind s.deadline(lastActive)
+	deadline int64
+	index    int // in the expiry heap
+}
+
+// shard holds the sessions whose IDs hash to it
+type shard struct {
+	sync.RWMutex
+	entries map[string]*entry
+	users   map[int64]map[string]*entry // the entries of each user
+	expiry  expiryHeap
+}
+
+// cache is an in-memory session store sharded by session ID. Expired sessions are found
+// through a min-heap of deadlines per shard so that pruning does not scan every session
+type cache struct {
+	shards [shardCount]shard
+}
+
+func newCache() *cache {
+	c := &cache{}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]*entry)
+		c.shards[i].users = make(map[int64]map[string]*entry)
+	}
+	return c
+}
+
+func (c *cache) shard(id string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &c.shards[h.Sum32()%shardCount]
+}
+
+// get returns the entry of session id or nil if it is not cached
+func (c *cache) get(id string) *entry {
+	sh := c.shard(id)
+	sh.RLock()
+	e := sh.entries[id]
+	sh.RUnlock()
+	return e
+}
+
+// put caches session s, which must not be changed afterwards, and returns its entry.
+// If s is already cached, the existing entry is returned instead
+func (c *cache) put(s *Session) *entry {
+	sh := c.shard(s.ID)
+	sh.Lock()
+	defer sh.Unlock()
+	if e, ok := sh.entries[s.ID]; ok {
+		return e
+	}
+	last := s.LastActive.UnixNano()
+	e := &entry{lastActive: last, saved: last, validated: time.Now().UnixNano(), s: s, deadline: s.deadline(last)}
+	sh.entries[s.ID] = e
+	if sh.users[s.UserID] == nil {
+		sh.users[s.UserID] = make(map[string]*entry)
+	}
+	sh.users[s.UserID][s.ID] = e
+	heap.Push(&sh.expiry, e)
+	return e
+}
+
+// remove deletes entry e from shard sh, which must be locked
+func (sh *shard) remove(e *entry) {
+	delete(sh.entries, e.s.ID)
+	delete(sh.users[e.s.UserID], e.s.ID)
+	if len(sh.users[e.s.UserID]) == 0 {
+		delete(sh.users, e.s.UserID)
+	}
+	heap.Remove(&sh.expiry, e.index)
+}
+
+// delete removes session id from the cache and reports whether it was cached
+func (c *cache) delete(id string) bool {
+	sh := c.shard(id)
+	sh.Lock()
+	defer sh.Unlock()
+	e, ok := sh.entries[id]
+	if ok {
+		sh.remove(e)
+	}
+	return ok
+}
+
+// userEntries returns the entries of the sessions of user uid
+func (c *cache) userEntries(uid int64) []*entry {
+	var list []*entry
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.RLock()
+		for _, e := range sh.users[uid] {
+			list = append(list, e)
+		}
+		sh.RUnlock()
+	}
+	return list
+}
+
+// deleteUser removes the sessions of user uid except keepID and returns their number
+func (c *cache) deleteUser(uid int64, keepID string) int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.Lock()
+		for id, e := range sh.users[uid] {
+			if id != keepID {
+				sh.remove(e)
+				n++
+			}
+		}
+		sh.Unlock()
+	}
+	return n
+}
+
+// prune removes the sessions expired at now (Unix nanoseconds) and returns their number.
+// Only entries whose deadline passed are visited: those still active are pushed back with
+// their new deadline, so each active session is visited at most once per idle timeout
+func (c *cache) prune(now int64) int {
+	n := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.Lock()
+		for len(sh.expiry) > 0 && sh.expiry[0].deadline <= now {
+			e := sh.expiry[0]
+			if deadline := e.s.deadline(atomic.LoadInt64(&e.lastActive)); deadline > now {
+				e.deadline = deadline
+				heap.Fix(&sh.expiry, 0)
+				continue
+			}
+			sh.remove(e)
+			n++
+		}
+		sh.Unlock()
+	}
+	return n
+}
+
+// expiryHeap is a min-heap of entries ordered by deadline; it implements heap.Interface
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
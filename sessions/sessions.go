@@ -1,35 +1,89 @@
 package sessions
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
 	"net/http"
-	"strconv"
-	"sync"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/drgo/realworld/errors"
+	"github.com/drgo/realworld/utils"
 )
 
-//FIXME: remove old/expired sessions
+// tokenScheme prefixes tokens in the Authorization header as in the realworld spec
+const tokenScheme = "Token "
 
-//Sessions is in-memory key-value session store
+// Backend stores sessions, eg in a database so that they survive restarts.
+// Its methods may be called concurrently
+type Backend interface {
+	// Save adds session s or, if it exists, updates it
+	Save(s *Session) error
+	// Load returns the session identified by id or nil if there is none
+	Load(id string) (*Session, error)
+	// Delete deletes the session identified by id, if any
+	Delete(id string) error
+	// ListUser returns the sessions of user uid
+	ListUser(uid int64) ([]*Session, error)
+	// DeleteUser deletes all sessions of user uid except the one with keepID
+	// and returns the number of deleted sessions
+	DeleteUser(uid int64, keepID string) (int, error)
+	// Prune deletes the sessions whose PruneAt time is before t and returns their number
+	Prune(t time.Time) (int, error)
+}
+
+// default lifetimes of sessions in seconds
+const (
+	defaultMaxAbsoluteLifeTime = 7 * 24 * 60 * 60  // 7 days, as long as a token is valid
+	defaultRememberIdleTime    = 7 * 24 * 60 * 60  // 7 days
+	defaultRememberLifeTime    = 30 * 24 * 60 * 60 // 30 days
+	defaultRevalidateInterval  = time.Minute
+)
+
+//Sessions is a key-value session store that keeps sessions in a Backend, in memory or in both.
+//A session expires when it is idle for longer than its idle time or, however active, when it
+//reaches its absolute lifetime. Remembered sessions ("remember me" logins) have longer limits
 type Sessions struct {
-	sync.RWMutex
-	lastCleaned time.Time
-	//max life of a cookie in seconds
+	//idle time of a session in seconds after which it expires
 	MaxLifeTime int
-	CookieName  string
-	store       map[string]*Session
-	ticker      *time.Ticker
-	done        chan interface{}
+	//time in seconds since login after which a session expires
+	MaxAbsoluteLifeTime int
+	//idle time and absolute lifetime of remembered sessions in seconds
+	RememberIdleTime int
+	RememberLifeTime int
+	//UserStamp, if set, returns a value that changes whenever the record of user uid changes in a
+	//way that should end the user's remembered sessions, eg a password change. It returns an error
+	//of kind errors.NotFound if the user does not exist
+	UserStamp func(uid int64) (string, error)
+	//RevalidateInterval is how often a cached remembered session is checked against the user record
+	//(0 checks it on every request). Sessions that are not cached are checked whenever they are loaded
+	RevalidateInterval time.Duration
+	CookieName         string
+	backend            Backend // nil if sessions are kept in memory only
+	cache              *cache  // nil if sessions are not kept in memory
+	ticker             *time.Ticker
+	done               chan interface{}
 }
 
-func NewSessionManager(cookieName string, maxLifeTime int) *Sessions {
+// NewSessionManager returns a session store that keeps sessions in backend or, if backend is nil,
+// in memory only. If cache is true, sessions read from backend are kept in memory so that
+// authenticating a request does not read backend; only use it if no other process changes backend
+func NewSessionManager(cookieName string, maxLifeTime int, backend Backend, cache bool) *Sessions {
 	ss := &Sessions{
-		CookieName:  cookieName,
-		MaxLifeTime: maxLifeTime,
-		store:       make(map[string]*Session),
-		lastCleaned: time.Now(),
+		CookieName:          cookieName,
+		MaxLifeTime:         maxLifeTime,
+		MaxAbsoluteLifeTime: defaultMaxAbsoluteLifeTime,
+		RememberIdleTime:    defaultRememberIdleTime,
+		RememberLifeTime:    defaultRememberLifeTime,
+		RevalidateInterval:  defaultRevalidateInterval,
+		backend:             backend,
+	}
+	if backend == nil || cache {
+		ss.cache = newCache()
 	}
 	// schedule pruning of expired sessions
 	ss.ticker = time.NewTicker(1000 * time.Millisecond)
@@ -40,7 +94,7 @@ func NewSessionManager(cookieName string, maxLifeTime int) *Sessions {
 			case <-ss.done:
 				return
 			case _ = <-ss.ticker.C:
-				ss.Prune(int64(ss.MaxLifeTime))
+				ss.Prune()
 			}
 		}
 	}()
@@ -54,61 +108,283 @@ func (ss *Sessions) Finalize() {
 	ss.done <- true
 }
 
-//GenSessionID returns a unique session ID
-func (ss *Sessions) GenSessionID() string {
-	p1 := time.Now().UnixNano()
-	p2 := rand.Int63()
-	//TODO: switch to appendFormat and preallocate storage eg var a [32]byte; var b=a[:0]
-	// eg https://golang.org/src/math/big/intconv.go?s=864:913#L20
-	return strconv.FormatInt(p1, 16) + strconv.FormatInt(p2, 16)
-	/*
-		// one possibility using a string (also uuid)
-		//source: https://astaxie.gitbooks.io/build-web-application-with-golang/content/en/06.2.html
-		b := make([]byte, 32)
-		if _, err := io.ReadFull(rand.Reader, b); err != nil {
-			return ""
-		}
-		return base64.URLEncoding.EncodeToString(b)
-	*/
+// sessionIDBytes is the number of random bytes in a session ID (256 bits of entropy)
+const sessionIDBytes = 32
+
+//GenSessionID returns a unique session ID that cannot be guessed
+func (ss *Sessions) GenSessionID() (string, error) {
+	b := make([]byte, sessionIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.E(err, "error generating session ID")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func (ss *Sessions) Add(uid int64) *Session {
-	s := &Session{ID: ss.GenSessionID(),
-		UserID:     uid,
-		LastActive: time.Now(),
-		Sessions:   ss,
+// Add starts a new session for user uid who logged in with request r. A remembered session
+// lasts longer and is checked against the user record (see UserStamp) from time to time
+func (ss *Sessions) Add(uid int64, remember bool, r *http.Request) (*Session, error) {
+	now := time.Now()
+	s := &Session{UserID: uid, CreatedAt: now, Remember: remember}
+	if remember {
+		s.IdleTimeout = seconds(ss.RememberIdleTime)
+		s.ExpiresAt = now.Add(seconds(ss.RememberLifeTime))
+	} else {
+		s.IdleTimeout = seconds(ss.MaxLifeTime)
+		s.ExpiresAt = now.Add(seconds(ss.MaxAbsoluteLifeTime))
 	}
-	ss.Lock()
-	ss.store[s.ID] = s
-	ss.Unlock()
-	return s
+	return ss.add(s, r)
 }
 
-func (ss *Sessions) GetExisting(sessionID string) *Session {
-	ss.RLock()
-	s, ok := ss.store[sessionID]
+// add starts session s, whose UserID, CreatedAt, Remember and lifetimes must be set, with a new
+// ID. The client's user agent and IP address are taken from request r
+func (ss *Sessions) add(s *Session, r *http.Request) (*Session, error) {
+	id, err := ss.GenSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s.ID = id
 	s.LastActive = time.Now()
-	ss.RUnlock()
-	if ok {
-		return s
+	s.UserAgent = r.UserAgent()
+	s.IP = clientIP(r)
+	s.Sessions = ss
+	if s.Remember && ss.UserStamp != nil {
+		if s.UserStamp, err = ss.UserStamp(s.UserID); err != nil {
+			return nil, errors.E(err, "error starting session")
+		}
+	}
+	if ss.backend != nil {
+		if err := ss.backend.Save(s); err != nil {
+			return nil, errors.E(err, "error saving session")
+		}
+	}
+	if ss.cache != nil {
+		ss.cache.put(s)
+	}
+	return s, nil
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// valid reports whether remembered session s still matches the record of its user, ie the user
+// exists and UserStamp did not change since s started. Other sessions are always valid
+func (ss *Sessions) valid(s *Session) (bool, error) {
+	if !s.Remember || ss.UserStamp == nil {
+		return true, nil
+	}
+	stamp, err := ss.UserStamp(s.UserID)
+	if errors.Is(errors.NotFound, err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.E(err, "error validating session")
+	}
+	return stamp == s.UserStamp, nil
+}
+
+// GetExisting returns the active session identified by sessionID, or nil if it expired or does not
+// exist, and marks it as active now. The returned session is shared by concurrent requests and must
+// not be changed. Unless sessions are cached, the idle time of a session is measured from the last
+// time it was saved and so it may expire up to a tenth of its IdleTimeout early. Remembered sessions
+// are validated whenever they are read from the backend and, once cached, every RevalidateInterval
+func (ss *Sessions) GetExisting(sessionID string) (*Session, error) {
+	now := time.Now()
+	if ss.cache != nil {
+		if e := ss.cache.get(sessionID); e != nil {
+			return ss.touch(e, now)
+		}
+		if ss.backend == nil { // eg, expired or deleted session
+			return nil, nil
+		}
+	}
+	s, err := ss.backend.Load(sessionID)
+	if err != nil {
+		return nil, errors.E(err, "error loading session")
+	}
+	if s == nil || s.expired(s.LastActive, now) { // eg, expired or deleted session
+		return nil, nil
+	}
+	s.Sessions = ss
+	if ok, err := ss.validate(s); !ok {
+		return nil, err
+	}
+	if ss.cache != nil {
+		return ss.touch(ss.cache.put(s), now)
+	}
+	if now.Sub(s.LastActive) >= s.saveInterval() {
+		s.LastActive = now
+		if err := ss.backend.Save(s); err != nil {
+			return nil, errors.E(err, "error saving session")
+		}
+	}
+	return s, nil
+}
+
+// validate is like valid but also deletes s if it is no longer valid
+func (ss *Sessions) validate(s *Session) (bool, error) {
+	ok, err := ss.valid(s)
+	if err == nil && !ok {
+		err = ss.Delete(s.ID)
+	}
+	return ok, err
+}
+
+// touch marks the session of cached entry e as active at now unless it expired, validating the
+// session every RevalidateInterval and saving the time to the backend every saveInterval. It only
+// updates e atomically so concurrent requests of the same session or of sessions in the same shard
+// do not wait for each other
+func (ss *Sessions) touch(e *entry, now time.Time) (*Session, error) {
+	t := now.UnixNano()
+	last := atomic.LoadInt64(&e.lastActive)
+	if t >= e.s.deadline(last) {
+		return nil, nil
+	}
+	if t > last {
+		// a concurrent request may store a slightly earlier time, which does not matter
+		atomic.StoreInt64(&e.lastActive, t)
+	}
+	// only the request that wins a swap validates or saves the session
+	if e.s.Remember {
+		if validated := atomic.LoadInt64(&e.validated); t-validated >= int64(ss.RevalidateInterval) &&
+			atomic.CompareAndSwapInt64(&e.validated, validated, t) {
+			if ok, err := ss.validate(e.s); !ok {
+				return nil, err
+			}
+		}
+	}
+	if saved := atomic.LoadInt64(&e.saved); t-saved >= int64(e.s.saveInterval()) &&
+		atomic.CompareAndSwapInt64(&e.saved, saved, t) {
+		if ss.backend != nil {
+			snapshot := *e.s
+			snapshot.LastActive = now
+			if err := ss.backend.Save(&snapshot); err != nil {
+				return nil, errors.E(err, "error saving session")
+			}
+		}
+	}
+	return e.s, nil
+}
+
+// Delete ends the session identified by sessionID, if any
+func (ss *Sessions) Delete(sessionID string) error {
+	if ss.cache != nil {
+		ss.cache.delete(sessionID)
+	}
+	if ss.backend != nil {
+		if err := ss.backend.Delete(sessionID); err != nil {
+			return errors.E(err, "error deleting session")
+		}
 	}
 	return nil
 }
 
-// Authenticate get an existing session or create a new one if none exists
-func (ss *Sessions) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, error) {
-	// does the request carry a session cookie
-	c, err := r.Cookie(ss.CookieName)
+// Rotate replaces session s by a new session of the same user with a new ID and deletes s.
+// Rotating the session when the user's privileges change (eg, on password change) prevents
+// anyone who obtained the old ID from using the session. The new session expires when s would
+// have and, if remembered, is validated against the changed user record. r is the request that
+// rotates it
+func (ss *Sessions) Rotate(s *Session, r *http.Request) (*Session, error) {
+	ns, err := ss.add(&Session{
+		UserID:      s.UserID,
+		CreatedAt:   s.CreatedAt,
+		ExpiresAt:   s.ExpiresAt,
+		IdleTimeout: s.IdleTimeout,
+		Remember:    s.Remember,
+	}, r)
 	if err != nil {
-		return nil, errors.E(err)
+		return nil, err
+	}
+	if err := ss.Delete(s.ID); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// UserSessions returns the active sessions of user uid, most recently active first.
+// The returned sessions are copies that the caller may change
+func (ss *Sessions) UserSessions(uid int64) ([]*Session, error) {
+	var list []*Session
+	if ss.backend != nil {
+		var err error
+		if list, err = ss.backend.ListUser(uid); err != nil {
+			return nil, errors.E(err, "error listing sessions")
+		}
+	}
+	if ss.cache != nil {
+		// cached sessions know when they were last active better than the backend
+		cached := map[string]*entry{}
+		for _, e := range ss.cache.userEntries(uid) {
+			cached[e.s.ID] = e
+		}
+		if ss.backend == nil {
+			for _, e := range cached {
+				s := *e.s
+				list = append(list, &s)
+			}
+		}
+		for _, s := range list {
+			if e, ok := cached[s.ID]; ok {
+				s.LastActive = time.Unix(0, atomic.LoadInt64(&e.lastActive))
+			}
+		}
+	}
+	now := time.Now()
+	active := list[:0]
+	for _, s := range list {
+		if !s.expired(s.LastActive, now) {
+			s.Sessions = ss
+			active = append(active, s)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].LastActive.After(active[j].LastActive) })
+	return active, nil
+}
+
+// DeleteUserSessions deletes all sessions of user uid except the one with keepID (eg, to log out
+// other devices after a password change) and returns the number of deleted sessions
+func (ss *Sessions) DeleteUserSessions(uid int64, keepID string) (int, error) {
+	n := 0
+	if ss.cache != nil {
+		n = ss.cache.deleteUser(uid, keepID)
+	}
+	if ss.backend != nil {
+		return ss.backend.DeleteUser(uid, keepID)
+	}
+	return n, nil
+}
+
+// Authenticate returns the existing session identified by the request's
+// "Authorization: Token <jwt>" header or, if there is no such header, by its session cookie
+func (ss *Sessions) Authenticate(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	var sessionID string
+	var uid int64
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		// does the request carry a valid token
+		if !strings.HasPrefix(auth, tokenScheme) {
+			return nil, errors.Errorf("unsupported authorization scheme")
+		}
+		claims, err := utils.ValidateToken(strings.TrimPrefix(auth, tokenScheme))
+		if err != nil {
+			return nil, errors.E(err)
+		}
+		sessionID, uid = claims.Id, claims.UserID
+	} else {
+		// does the request carry a session cookie
+		c, err := r.Cookie(ss.CookieName)
+		if err != nil {
+			return nil, errors.E(err)
+		}
+		sessionID = c.Value
 	}
 	// do we have a valid active session with this id
-	s := ss.GetExisting(c.Value)
-	if s == nil { // no valid session
+	s, err := ss.GetExisting(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || (uid != 0 && s.UserID != uid) { // no valid session
 		return nil, errors.Errorf("no such session")
 	}
-	//FIXME: test
-	s.LastActive = time.Now()
 	// logged in
 	return s, nil
 }
@@ -141,10 +417,73 @@ func (ss *Sessions) Authenticate(w http.ResponseWriter, r *http.Request) (*Sessi
 
 // user session
 type Session struct {
-	ID         string
-	LastActive time.Time
-	UserID     int64
-	Sessions   *Sessions
+	ID          string
+	CreatedAt   time.Time
+	LastActive  time.Time
+	ExpiresAt   time.Time     // when the session expires however active it is
+	IdleTimeout time.Duration // idle time after which the session expires
+	Remember    bool          // started by a "remember me" login
+	UserStamp   string        // of the user when a remembered session started (see Sessions.UserStamp)
+	UserID      int64
+	UserAgent   string // of the client that logged in
+	IP          string // of the client that logged in
+	Sessions    *Sessions
+}
+
+// expired reports whether the session, last active at lastActive, expired at now
+func (s *Session) expired(lastActive, now time.Time) bool {
+	return now.UnixNano() >= s.deadline(lastActive.UnixNano())
+}
+
+// deadline returns the time the session expires, in Unix nanoseconds, if it is last active at
+// lastActive (Unix nanoseconds)
+func (s *Session) deadline(lastActive int64) int64 {
+	if d := lastActive + int64(s.IdleTimeout); d < s.ExpiresAt.UnixNano() {
+		return d
+	}
+	return s.ExpiresAt.UnixNano()
+}
+
+// saveInterval is how often the LastActive time of the active session is saved to the backend.
+// Saving it on every request would turn every read into a write
+func (s *Session) saveInterval() time.Duration {
+	return s.IdleTimeout / 10
+}
+
+// PruneAt returns the time after which a backend may delete the session. As LastActive is only
+// saved every saveInterval, an idle session is kept that much longer than its IdleTimeout
+func (s *Session) PruneAt() time.Time {
+	if t := s.LastActive.Add(s.IdleTimeout + s.saveInterval()); t.Before(s.ExpiresAt) {
+		return t
+	}
+	return s.ExpiresAt
+}
+
+// PublicID returns an identifier of the session that can be shown to the user without
+// revealing its ID, which is as secret as a password
+func (s *Session) PublicID() string {
+	h := sha256.Sum256([]byte(s.ID))
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
+
+// clientIP returns the IP address of the client that sent r. Headers such as X-Forwarded-For
+// are ignored because clients can forge them
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ExpiredCookie returns a cookie that deletes the session cookie from the client, eg on logout
+func (ss *Sessions) ExpiredCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     ss.CookieName,
+		Path:     "/",
+		HttpOnly: true,
+		MaxAge:   -1,
+	}
 }
 
 func (s *Session) NewCookie() *http.Cookie {
@@ -155,7 +494,10 @@ func (s *Session) NewCookie() *http.Cookie {
 		//FIXME: enable secure
 		// Secure:   true, //only sent over HTTPS
 		HttpOnly: true, //do not allow JS code to access it; some protection against XSS attacks
-		MaxAge:   s.Sessions.MaxLifeTime,
+	}
+	// a remembered session outlives the browser session; others end with it
+	if s.Remember {
+		c.MaxAge = int(time.Until(s.ExpiresAt).Seconds())
 	}
 	// uncomment if compatability with IE is needed
 	// if c.MaxAge > 0 {
@@ -167,62 +509,22 @@ func (s *Session) NewCookie() *http.Cookie {
 	return c
 }
 
-// Prune deletes expired sessions by deleting entries in the sessions store that
-// have expired (time.now > time last active + MaxLifeTime)
-func (ss *Sessions) Prune(maxLifeTime int64) {
-	ss.Lock()
-	defer ss.Unlock()
-	for sid, s := range ss.store {
-		if time.Now().Unix() > (s.LastActive.Unix() + maxLifeTime) {
-			delete(ss.store, sid)
-		}
-	}
-}
-
-//TODO: refresh session in response to /refresh
-// func Refresh(w http.ResponseWriter, r *http.Request) {
-// 	// (BEGIN) The code uptil this point is the same as the first part of the `Welcome` route
-// 	  c, err := r.Cookie("session_token")
-// 	  if err != nil {
-// 		  if err == http.ErrNoCookie {
-// 			  w.WriteHeader(http.StatusUnauthorized)
-// 			  return
-// 		  }
-// 		  w.WriteHeader(http.StatusBadRequest)
-// 		  return
-// 	  }
-// 	  sessionToken := c.Value
-
-// 	  response, err := cache.Do("GET", sessionToken)
-// 	  if err != nil {
-// 		  w.WriteHeader(http.StatusInternalServerError)
-// 		  return
-// 	  }
-// 	  if response == nil {
-// 		  w.WriteHeader(http.StatusUnauthorized)
-// 		  return
-// 	  }
-// 	  // (END) The code uptil this point is the same as the first part of the `Welcome` route
-
-// 	  // Now, create a new session token for the current user
-// 	  newSessionToken := uuid.NewV4().String()
-// 	  _, err = cache.Do("SETEX", newSessionToken, "120", fmt.Sprintf("%s",response))
-// 	  if err != nil {
-// 		  w.WriteHeader(http.StatusInternalServerError)
-// 		  return
-// 	  }
-
-// 	  // Delete the older session token
-// 	  _, err = cache.Do("DEL", sessionToken)
-// 	  if err != nil {
-// 		  w.WriteHeader(http.StatusInternalServerError)
-// 		  return
-// 	  }
-
-// 	  // Set the new token as the users `session_token` cookie
-// 	  http.SetCookie(w, &http.Cookie{
-// 		  Name:    "session_token",
-// 		  Value:   newSessionToken,
-// 		  Expires: time.Now().Add(120 * time.Second),
-// 	  })
-//   }
+// Token returns a signed token identifying the session to be sent in the Authorization header
+// of subsequent requests
+func (s *Session) Token() (string, error) {
+	return utils.NewToken(s.UserID, s.ID, s.ExpiresAt)
+}
+
+// Prune deletes expired sessions, ie those idle for longer than their IdleTimeout or
+// past their ExpiresAt time
+func (ss *Sessions) Prune() {
+	now := time.Now()
+	if ss.cache != nil {
+		ss.cache.prune(now.UnixNano())
+	}
+	if ss.backend != nil {
+		if _, err := ss.backend.Prune(now); err != nil {
+			errors.Logf("error pruning sessions: %v\n", err)
+		}
+	}
+}
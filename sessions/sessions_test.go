@@ -0,0 +1,356 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/drgo/realworld/errors"
+)
+
+// mapBackend is a Backend for tests
+type mapBackend struct {
+	sync.Mutex
+	m map[string]Session
+}
+
+func newMapBackend() *mapBackend { return &mapBackend{m: map[string]Session{}} }
+
+func (mb *mapBackend) Save(s *Session) error {
+	mb.Lock()
+	defer mb.Unlock()
+	mb.m[s.ID] = *s
+	return nil
+}
+
+func (mb *mapBackend) Load(id string) (*Session, error) {
+	mb.Lock()
+	defer mb.Unlock()
+	if s, ok := mb.m[id]; ok {
+		return &s, nil
+	}
+	return nil, nil
+}
+
+func (mb *mapBackend) Delete(id string) error {
+	mb.Lock()
+	defer mb.Unlock()
+	delete(mb.m, id)
+	return nil
+}
+
+func (mb *mapBackend) ListUser(uid int64) ([]*Session, error) {
+	mb.Lock()
+	defer mb.Unlock()
+	var list []*Session
+	for _, s := range mb.m {
+		if s.UserID == uid {
+			s := s
+			list = append(list, &s)
+		}
+	}
+	return list, nil
+}
+
+func (mb *mapBackend) DeleteUser(uid int64, keepID string) (int, error) {
+	mb.Lock()
+	defer mb.Unlock()
+	n := 0
+	for id, s := range mb.m {
+		if s.UserID == uid && id != keepID {
+			delete(mb.m, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (mb *mapBackend) Prune(t time.Time) (int, error) {
+	mb.Lock()
+	defer mb.Unlock()
+	n := 0
+	for id, s := range mb.m {
+		if s.PruneAt().Before(t) {
+			delete(mb.m, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// managers returns session managers for each kind of storage
+func managers(t testing.TB, maxLifeTime int) map[string]*Sessions {
+	ms := map[string]*Sessions{
+		"memory":  NewSessionManager("session", maxLifeTime, nil, false),
+		"backend": NewSessionManager("session", maxLifeTime, newMapBackend(), false),
+		"cached":  NewSessionManager("session", maxLifeTime, newMapBackend(), true),
+	}
+	for _, ss := range ms {
+		t.Cleanup(ss.Finalize)
+	}
+	return ms
+}
+
+func TestSessions(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/users/login", nil)
+	for name, ss := range managers(t, 60) {
+		s1, err := ss.Add(1, false, r)
+		check(t, err)
+		s2, err := ss.Add(1, false, r)
+		check(t, err)
+		if s, err := ss.GetExisting(s1.ID); err != nil || s == nil || s.UserID != 1 {
+			t.Errorf("%s: want session of user 1, got %v (%v)", name, s, err)
+		}
+		if s, err := ss.GetExisting("unknown"); err != nil || s != nil {
+			t.Errorf("%s: want no session for unknown ID, got %v (%v)", name, s, err)
+		}
+		if list, err := ss.UserSessions(1); err != nil || len(list) != 2 {
+			t.Errorf("%s: want 2 sessions, got %v (%v)", name, list, err)
+		}
+		if n, err := ss.DeleteUserSessions(1, s2.ID); err != nil || n != 1 {
+			t.Errorf("%s: want 1 session deleted, got %d (%v)", name, n, err)
+		}
+		if s, _ := ss.GetExisting(s1.ID); s != nil {
+			t.Errorf("%s: deleted session still exists", name)
+		}
+		check(t, ss.Delete(s2.ID))
+		if s, _ := ss.GetExisting(s2.ID); s != nil {
+			t.Errorf("%s: deleted session still exists", name)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	const maxLifeTime = 60
+	old := time.Now().Add(-2 * maxLifeTime * time.Second)
+	expiresAt := time.Now().Add(time.Hour)
+	for name, ss := range managers(t, maxLifeTime) {
+		expired := &Session{ID: "expired", UserID: 1, LastActive: old, ExpiresAt: expiresAt,
+			IdleTimeout: maxLifeTime * time.Second, Sessions: ss}
+		active := &Session{ID: "active", UserID: 1, LastActive: old, ExpiresAt: expiresAt,
+			IdleTimeout: maxLifeTime * time.Second, Sessions: ss}
+		if ss.backend != nil {
+			check(t, ss.backend.Save(expired))
+			saved := *active
+			saved.LastActive = time.Now()
+			check(t, ss.backend.Save(&saved))
+		}
+		if ss.cache != nil {
+			ss.cache.put(expired)
+			// cached with an old deadline but used since, as if it had been touched
+			atomic.StoreInt64(&ss.cache.put(active).lastActive, time.Now().UnixNano())
+		}
+		if s, _ := ss.GetExisting("expired"); s != nil {
+			t.Errorf("%s: expired session returned", name)
+		}
+		ss.Prune()
+		if s, _ := ss.GetExisting("active"); s == nil {
+			t.Errorf("%s: active session pruned", name)
+		}
+		if ss.cache != nil {
+			if ss.cache.get("expired") != nil {
+				t.Errorf("%s: expired session not pruned from the cache", name)
+			}
+			if e := ss.cache.get("active"); e == nil || e.deadline <= time.Now().UnixNano() {
+				t.Errorf("%s: active session not pushed back with a new deadline", name)
+			}
+		}
+		if ss.backend != nil {
+			if s, _ := ss.backend.Load("expired"); s != nil {
+				t.Errorf("%s: expired session not pruned from the backend", name)
+			}
+		}
+	}
+}
+
+func TestAbsoluteExpiry(t *testing.T) {
+	for name, ss := range managers(t, 60) {
+		// active now but past its absolute lifetime
+		s := &Session{ID: "old", UserID: 1, LastActive: time.Now(), ExpiresAt: time.Now().Add(-time.Second),
+			IdleTimeout: time.Minute, Sessions: ss}
+		if ss.backend != nil {
+			check(t, ss.backend.Save(s))
+		}
+		if ss.cache != nil {
+			ss.cache.put(s)
+		}
+		if s, _ := ss.GetExisting("old"); s != nil {
+			t.Errorf("%s: session past its absolute lifetime returned", name)
+		}
+		ss.Prune()
+		if ss.cache != nil && ss.cache.get("old") != nil {
+			t.Errorf("%s: expired session not pruned from the cache", name)
+		}
+		if ss.backend != nil {
+			if s, _ := ss.backend.Load("old"); s != nil {
+				t.Errorf("%s: expired session not pruned from the backend", name)
+			}
+		}
+	}
+}
+
+func TestRememberedSessions(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/users/login", nil)
+	for name, ss := range managers(t, 60) {
+		var mu sync.Mutex
+		stamps := map[int64]string{1: "a"}
+		ss.UserStamp = func(uid int64) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if stamp, ok := stamps[uid]; ok {
+				return stamp, nil
+			}
+			return "", errors.E(errors.NotFound, "user not found")
+		}
+		ss.RememberIdleTime = 1
+		ss.RevalidateInterval = 100 * time.Millisecond
+		s, err := ss.Add(1, true, r)
+		check(t, err)
+		if c := s.NewCookie(); c.MaxAge < ss.RememberLifeTime-60 {
+			t.Errorf("%s: want a cookie kept for %ds, got MaxAge %d", name, ss.RememberLifeTime, c.MaxAge)
+		}
+		if s.UserStamp != "a" || s.IdleTimeout != time.Second {
+			t.Errorf("%s: remembered session has stamp %q and idle time %v", name, s.UserStamp, s.IdleTimeout)
+		}
+		other, err := ss.Add(1, false, r)
+		check(t, err)
+		if c := other.NewCookie(); c.MaxAge != 0 {
+			t.Errorf("%s: want a browser session cookie, got MaxAge %d", name, c.MaxAge)
+		}
+		// rotating after the user record changed keeps the session valid
+		mu.Lock()
+		stamps[1] = "b"
+		mu.Unlock()
+		s, err = ss.Rotate(s, r)
+		check(t, err)
+		if !s.Remember || s.UserStamp != "b" {
+			t.Errorf("%s: rotated session not remembered with the new stamp", name)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if got, err := ss.GetExisting(s.ID); err != nil || got == nil {
+			t.Errorf("%s: want valid remembered session, got %v (%v)", name, got, err)
+		}
+		// a change by someone else ends it the next time it is validated
+		mu.Lock()
+		stamps[1] = "c"
+		mu.Unlock()
+		time.Sleep(150 * time.Millisecond)
+		if got, err := ss.GetExisting(s.ID); err != nil || got != nil {
+			t.Errorf("%s: want no session after the user changed, got %v (%v)", name, got, err)
+		}
+		if got, _ := ss.GetExisting(other.ID); got == nil {
+			t.Errorf("%s: session that is not remembered was ended", name)
+		}
+	}
+}
+
+// TestConcurrentSessions is meant to be run with -race
+func TestConcurrentSessions(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/users/login", nil)
+	for name, ss := range managers(t, 60) {
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(uid int64) {
+				defer wg.Done()
+				var ids []string
+				for i := 0; i < 200; i++ {
+					s, err := ss.Add(uid, false, r)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ids = append(ids, s.ID)
+					for _, id := range ids[len(ids)/2:] {
+						if _, err := ss.GetExisting(id); err != nil {
+							t.Error(err)
+						}
+					}
+					switch i % 50 {
+					case 10:
+						ss.Prune()
+					case 20:
+						ss.UserSessions(uid)
+					case 30:
+						ss.Rotate(s, r)
+					case 40:
+						ss.DeleteUserSessions(uid, s.ID)
+					}
+				}
+			}(int64(g % 3))
+		}
+		wg.Wait()
+		if t.Failed() {
+			t.Fatalf("%s: concurrent use failed", name)
+		}
+	}
+}
+
+func check(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkGetExisting looks up sessions from about 80 concurrent goroutines (like wrk -c 80) while
+// the pruner runs, and reports the 99th percentile latency of a lookup
+func BenchmarkGetExisting(b *testing.B) {
+	defer func(debug bool) { errors.Debug = debug }(errors.Debug)
+	errors.Debug = false
+	const sessions = 100000
+	const clients = 80
+	ids := make([]string, sessions)
+	r := httptest.NewRequest("POST", "/api/users/login", nil)
+	ss := NewSessionManager("session", 600, nil, false)
+	defer ss.Finalize()
+	for i := range ids {
+		s, err := ss.Add(int64(i), false, r)
+		check(b, err)
+		ids[i] = s.ID
+	}
+	// prune more often than the server does so that short runs see its effect
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ss.Prune()
+			}
+		}
+	}()
+	var mu sync.Mutex
+	var latencies []time.Duration
+	var seq int64
+	// RunParallel starts parallelism×GOMAXPROCS goroutines
+	procs := runtime.GOMAXPROCS(0)
+	b.SetParallelism((clients + procs - 1) / procs)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var local []time.Duration
+		i := int(atomic.AddInt64(&seq, 7919))
+		for pb.Next() {
+			i++
+			start := time.Now()
+			ss.GetExisting(ids[i%sessions])
+			local = append(local, time.Since(start))
+		}
+		mu.Lock()
+		latencies = append(latencies, local...)
+		mu.Unlock()
+	})
+	b.StopTimer()
+	close(stop)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) > 0 {
+		b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+	}
+}
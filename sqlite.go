@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	sql "crawshaw.io/sqlite"
 	sqlx "crawshaw.io/sqlite/sqlitex"
 	"github.com/drgo/realworld/errors"
 )
 
+// DefaultPoolSize is the number of read connections; all writes share a single connection
 const DefaultPoolSize = 10
 
 // A flags value of 0 defaults to:
@@ -16,33 +23,124 @@ const DefaultPoolSize = 10
 //	SQLITE_OPEN_NOMUTEX
 const DefaultPoolFlags = 0
 
+// busyTimeout is how long a connection waits for a lock held by another connection (eg, of the
+// migrate command) before failing with SQLITE_BUSY
+const busyTimeout = 5 * time.Second
+
+// per-connection settings, see https://phiresky.github.io/blog/2020/sqlite-performance-tuning/
+// They are run one by one because some (eg, synchronous) cannot be changed inside the savepoint
+// sqlitex.ExecScript wraps a script in, see https://github.com/crawshaw/sqlite/issues/101
+var (
+	writerPragmas = []string{
+		"pragma synchronous = normal",
+		"pragma temp_store = memory",
+		"pragma mmap_size = 30000000000",
+		"pragma page_size = 32768",
+	}
+	readerPragmas = []string{
+		"pragma query_only = true",
+		"pragma temp_store = memory",
+		"pragma mmap_size = 30000000000",
+	}
+)
+
+// sqlite sends writes to a single connection so that writers queue in Go rather than fail with
+// SQLITE_BUSY, and reads to a pool of read-only connections which in WAL mode do not block on
+// (and are not blocked by) the writer
 type sqlite struct {
-	pool     *sqlx.Pool
+	writer   *sqlx.Pool // one connection for Exec and Tx
+	pool     *sqlx.Pool // read-only connections for Query and JSONQuery
 	poolSize int
+	// ctx, if not nil, interrupts queries when it is done (eg, when the client disconnects)
+	ctx context.Context
+	// queryTimeout, if not zero, limits the time spent waiting for a connection and running
+	// a query or a transaction
+	queryTimeout time.Duration
 }
 
 // // Guarantee that sqlite implements the DB interface
 // var _ DB = (*sqlite)(nil)
 
-// NewDB opens a fixed-size pool of SQLite connections
+// NewDB opens the write connection and a fixed-size pool of read connections to SQLite database dsn.
+// The directory of database file dsn is created if it does not exist
 func NewDB(dsn string, poolFlags sql.OpenFlags, poolSize int) (*sqlite, error) {
 	db := sqlite{poolSize: poolSize}
+	if !strings.HasPrefix(dsn, "file:") {
+		if err := os.MkdirAll(filepath.Dir(dsn), 0755); err != nil {
+			return nil, err
+		}
+	}
 	var err error
-	db.pool, err = sqlx.Open(dsn, poolFlags, poolSize)
-	if err != nil {
+	// open the writer first so that it creates the database and sets its page size
+	if db.writer, err = sqlx.Open(dsn, poolFlags, 1); err != nil {
 		return nil, err
 	}
-	if err = db.ApplyPragmas(`
-	pragma temp_store = memory;
-	pragma mmap_size = 30000000000;
-	pragma page_size = 32768;`); err != nil {
+	if err = configurePool(db.writer, 1, writerPragmas); err != nil {
+		db.writer.Close()
+		return nil, err
+	}
+	if db.pool, err = sqlx.Open(dsn, poolFlags, poolSize); err != nil {
+		db.writer.Close()
+		return nil, err
+	}
+	if err = configurePool(db.pool, poolSize, readerPragmas); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return &db, nil
 }
 
 func (db *sqlite) Close() error {
-	return db.pool.Close()
+	err := db.pool.Close()
+	if werr := db.writer.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// WithContext returns a copy of db whose queries are interrupted when ctx is done
+func (db *sqlite) WithContext(ctx context.Context) *sqlite {
+	db2 := *db
+	db2.ctx = ctx
+	return &db2
+}
+
+// withConn runs fn with a connection from pool. Waiting for the connection and running fn are
+// interrupted when db's context is done or the query timeout expires, which is reported as a Timeout
+// (deadline exceeded) or an Unavailable (eg, client disconnected or server shutting down) error
+func (db *sqlite) withConn(pool *sqlx.Pool, fn func(conn *sql.Conn) error) error {
+	ctx := db.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if db.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, db.queryTimeout)
+		defer cancel()
+	}
+	conn := pool.Get(ctx)
+	if conn == nil {
+		if ctx.Err() != nil {
+			return interrupted(ctx.Err())
+		}
+		return errors.Errorf("database is closed")
+	}
+	defer pool.Put(conn)
+	if err := fn(conn); err != nil {
+		if ctx.Err() != nil {
+			return interrupted(ctx.Err())
+		}
+		return err
+	}
+	return nil
+}
+
+// interrupted returns the error reported when a query is interrupted because of ctxErr
+func interrupted(ctxErr error) error {
+	if ctxErr == context.DeadlineExceeded {
+		return errors.E(errors.Timeout, "database query timed out")
+	}
+	return errors.E(errors.Unavailable, "database query canceled")
 }
 
 //FIXME: see sqlitex code
@@ -62,29 +160,35 @@ func bindQuery(stmt *sql.Stmt, args Args) error {
 			stmt.SetBool(k, tv)
 		case []byte:
 			stmt.SetBytes(k, tv)
+		case nil:
+			stmt.SetNull(k)
 		default:
 			return errors.Errorf("%s has unsupported type", k)
 		}
-		//TODO: SetNull needed?
 	}
 	return nil
 }
 
 func (db *sqlite) Query(query string, args Args) (rows []Row, rowCount int, err error) {
-	conn := db.pool.Get(nil)
-	defer db.pool.Put(conn)
+	err = db.withConn(db.pool, func(conn *sql.Conn) error {
+		rows, rowCount, err = connQuery(conn, query, args)
+		return err
+	})
+	return rows, rowCount, err
+}
+
+func connQuery(conn *sql.Conn, query string, args Args) (rows []Row, rowCount int, err error) {
 	_ = errors.Debug && errors.Logln("Query:", query)
 	//compile (and cache) query; no need to finalize it
-	stmt := conn.Prep(query)
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return nil, 0, err
+	}
 	// bind args to compiled statement
 	if err := bindQuery(stmt, args); err != nil {
 		return nil, 0, err
 	}
-	defer func() {
-		if err := stmt.Reset(); err != nil {
-			panic(err)
-		}
-	}()
+	defer resetStmt(stmt, &err)
 	// TODO: not clear if needed https://stackoverflow.com/questions/35741175/sqlite3-reset-when-is-it-needed
 	// step through returned records and retrieve info
 	for {
@@ -108,9 +212,11 @@ func (db *sqlite) Query(query string, args Args) (rows []Row, rowCount int, err
 			case sql.SQLITE_TEXT:
 				row[name] = stmt.ColumnText(i)
 			case sql.SQLITE_BLOB:
-				//TODO:
+				b := make([]byte, stmt.ColumnLen(i))
+				stmt.ColumnBytes(i, b)
+				row[name] = b
 			case sql.SQLITE_NULL:
-				row[name] = ""
+				row[name] = nil
 			}
 		}
 		rows = append(rows, row)
@@ -118,23 +224,28 @@ func (db *sqlite) Query(query string, args Args) (rows []Row, rowCount int, err
 	return rows, len(rows), nil
 }
 
-// Exec
-// returns the number of rows modified, inserted or deleted by the most recently completed INSERT, UPDATE or DELETE; usually returns the rowid of the most recent successful INSERT or error
+// Exec executes a statement that does not return records (eg INSERT, UPDATE or DELETE).
+// It returns the number of rows modified, inserted or deleted by the most recently completed INSERT, UPDATE or DELETE; usually returns the rowid of the most recent successful INSERT or error
 func (db *sqlite) Exec(query string, args Args) (rowsAffected int, lastRowID int64, err error) {
-	conn := db.pool.Get(nil)
-	defer db.pool.Put(conn)
+	err = db.withConn(db.writer, func(conn *sql.Conn) error {
+		rowsAffected, lastRowID, err = connExec(conn, query, args)
+		return err
+	})
+	return rowsAffected, lastRowID, err
+}
+
+func connExec(conn *sql.Conn, query string, args Args) (rowsAffected int, lastRowID int64, err error) {
 	_ = errors.Debug && errors.Logln("Exec:", query)
 	//compile (and cache) query; no need to finalize it
-	stmt := conn.Prep(query)
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return 0, 0, err
+	}
 	// bind args to compiled statement
 	if err = bindQuery(stmt, args); err != nil {
 		return 0, 0, err
 	}
-	defer func() {
-		if err = stmt.Reset(); err != nil {
-			panic(err)
-		}
-	}()
+	defer resetStmt(stmt, &err)
 	if _, err = stmt.Step(); err != nil {
 		return 0, 0, err
 	}
@@ -142,20 +253,25 @@ func (db *sqlite) Exec(query string, args Args) (rowsAffected int, lastRowID int
 }
 
 func (db *sqlite) JSONQuery(query string, args Args) (result string, rowCount int, err error) {
-	conn := db.pool.Get(nil)
-	defer db.pool.Put(conn)
+	err = db.withConn(db.pool, func(conn *sql.Conn) error {
+		result, rowCount, err = connJSONQuery(conn, query, args)
+		return err
+	})
+	return result, rowCount, err
+}
+
+func connJSONQuery(conn *sql.Conn, query string, args Args) (result string, rowCount int, err error) {
 	_ = errors.Debug && errors.Logln("JSONQuery:", query)
 	//compile (and cache) query; no need to finalize it
-	stmt := conn.Prep(query)
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return "", 0, err
+	}
 	// bind args to compiled statement
 	if err := bindQuery(stmt, args); err != nil {
 		return "", 0, err
 	}
-	defer func() {
-		if err := stmt.Reset(); err != nil {
-			panic(err)
-		}
-	}()
+	defer resetStmt(stmt, &err)
 	if hasRow, err := stmt.Step(); err != nil {
 		return "", 0, err
 	} else if !hasRow {
@@ -166,6 +282,46 @@ func (db *sqlite) JSONQuery(query string, args Args) (result string, rowCount in
 	return result, 1, nil
 }
 
+// resetStmt resets stmt so that it can be reused and, unless *errp already holds the error of a
+// failed step (which reset returns again), reports a failed reset in *errp
+func resetStmt(stmt *sql.Stmt, errp *error) {
+	if err := stmt.Reset(); err != nil && *errp == nil {
+		*errp = err
+	}
+}
+
+// Tx executes statements on the single connection that holds a transaction
+type Tx struct {
+	conn *sql.Conn
+}
+
+// Tx runs fn inside a transaction on the write connection, which also runs its queries.
+// The transaction is committed if fn returns nil and rolled back if fn returns an error or panics.
+// The query timeout applies to the whole transaction
+func (db *sqlite) Tx(fn func(tx *Tx) error) error {
+	return db.withConn(db.writer, func(conn *sql.Conn) (err error) {
+		defer sqlx.Save(conn)(&err)
+		return fn(&Tx{conn: conn})
+	})
+}
+
+func (tx *Tx) Query(query string, args Args) (rows []Row, rowCount int, err error) {
+	return connQuery(tx.conn, query, args)
+}
+
+func (tx *Tx) Exec(query string, args Args) (rowsAffected int, lastRowID int64, err error) {
+	return connExec(tx.conn, query, args)
+}
+
+func (tx *Tx) JSONQuery(query string, args Args) (result string, rowCount int, err error) {
+	return connJSONQuery(tx.conn, query, args)
+}
+
+// ExecScript executes a script of statements separated by semicolons (eg, a migration)
+func (tx *Tx) ExecScript(script string) error {
+	return sqlx.ExecScript(tx.conn, script)
+}
+
 // TODO: cleanup
 // func (db *sqliteDb) cleanup() {
 // 	conn := db.pool.Get(context.TODO())
@@ -179,14 +335,24 @@ func (db *sqlite) JSONQuery(query string, args Args) (result string, rowCount in
 // 		db.cleanup()
 // 	}
 // }
-func (db *sqlite) ApplyPragmas(pragmas string) error {
-	for i := 0; i < db.poolSize; i++ {
-		conn := db.pool.Get(nil)
-		if err := sqlx.ExecScript(conn, pragmas); err != nil {
-			db.pool.Close()
-			return err
+// configurePool sets the busy timeout and applies pragmas to each of the n connections of pool.
+// All connections are taken out of the pool first so that none is configured twice or skipped
+func configurePool(pool *sqlx.Pool, n int, pragmas []string) error {
+	conns := make([]*sql.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn := pool.Get(nil)
+		conns = append(conns, conn)
+		conn.SetBusyTimeout(busyTimeout)
+		for _, pragma := range pragmas {
+			if err := sqlx.ExecTransient(conn, pragma, nil); err != nil {
+				return err
+			}
 		}
-		db.pool.Put(conn)
 	}
 	return nil
 }
@@ -1,16 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/drgo/realworld/errors"
 )
 
-//TODO: create database just for testing
-func TestFindNoArgs(t *testing.T) {
-	db, err := NewDB("db/rw.db")
+// newTestDB returns a database migrated to the latest schema in a temporary directory
+func newTestDB(t testing.TB) *sqlite {
+	t.Helper()
+	db, err := NewDB(filepath.Join(t.TempDir(), "rw.db"), DefaultPoolFlags, DefaultPoolSize)
 	check(t, err)
-	defer db.Close()
+	t.Cleanup(func() { db.Close() })
+	check(t, db.Migrate(-1))
+	return db
+}
+
+// addTestUsers adds users t1..tn with emails t1@t.ca..tn@t.ca
+func addTestUsers(t testing.TB, db *sqlite, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		_, _, err := db.Exec("INSERT INTO User(email, userName) Values($email,$username)",
+			Args{"$email": fmt.Sprintf("t%d@t.ca", i), "$username": fmt.Sprintf("t%d", i)})
+		check(t, err)
+	}
+}
+
+func TestFindNoArgs(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 3)
 	rows, n, err := db.Query("select * from User", nil)
 	check(t, err)
 	fmt.Println(n)
@@ -20,27 +45,30 @@ func TestFindNoArgs(t *testing.T) {
 }
 
 func TestFindNoArgsNull(t *testing.T) {
-	db, err := NewDB("db/rw.db")
-	check(t, err)
-	defer db.Close()
+	db := newTestDB(t)
+	addTestUsers(t, db, 3)
 	rows, n, err := db.Query("select id, image from User", nil)
 	check(t, err)
 	fmt.Println(n)
 	for _, row := range rows {
 		fmt.Println(row)
+		if image, ok := row["image"]; !ok || image != nil {
+			t.Errorf("want NULL image as nil, got %#v", image)
+		}
 	}
 }
 
 func TestFindWithArgs(t *testing.T) {
-	db, err := NewDB("db/rw.db")
-	check(t, err)
-	defer db.Close()
-	findTest := func(email string) string {
+	db := newTestDB(t)
+	addTestUsers(t, db, 3)
+	findTest := func(email string, want int) string {
 		rows, n, err := db.Query("select id, email, emailConfirmed from User where email= $email",
 			Args{"$email": email})
 		check(t, err)
-		if n != 1 {
-			t.Errorf("wrong result, wanted %d records, got %d", 1, n)
+		if n != want {
+			t.Errorf("wrong result, wanted %d records, got %d", want, n)
+		}
+		if n == 0 {
 			return "nothing found"
 		}
 		json, err := json.MarshalIndent(rows[0], "", "")
@@ -49,16 +77,14 @@ func TestFindWithArgs(t *testing.T) {
 		// }
 		return string(json)
 	}
-	t.Log(findTest("t1@t.ca"))
-	t.Log(findTest("t2@t.ca"))
-	t.Log(findTest("t1@t.can"))
-	t.Log(findTest("t3@t.ca"))
+	t.Log(findTest("t1@t.ca", 1))
+	t.Log(findTest("t2@t.ca", 1))
+	t.Log(findTest("t1@t.can", 0))
+	t.Log(findTest("t3@t.ca", 1))
 }
 
 func TestExec(t *testing.T) {
-	db, err := NewDB("db/rw.db")
-	check(t, err)
-	defer db.Close()
+	db := newTestDB(t)
 	n, id, err := db.Exec("INSERT INTO User(email, userName) Values($email,$username)",
 		Args{"$email": "t6@t.ca", "$username": "t6"})
 	check(t, err)
@@ -107,3 +133,211 @@ func TestExec(t *testing.T) {
 // 		})
 // 	}
 // }
+
+func TestTx(t *testing.T) {
+	db := newTestDB(t)
+	insert := func(tx *Tx, email string) {
+		_, _, err := tx.Exec("INSERT INTO User(email, userName) Values($email,$email)", Args{"$email": email})
+		check(t, err)
+	}
+	count := func(email string) int {
+		_, n, err := db.Query("select id from User where email= $email", Args{"$email": email})
+		check(t, err)
+		return n
+	}
+	check(t, db.Tx(func(tx *Tx) error {
+		insert(tx, "commit@t.ca")
+		return nil
+	}))
+	if count("commit@t.ca") != 1 {
+		t.Errorf("committed insert not found")
+	}
+	if err := db.Tx(func(tx *Tx) error {
+		insert(tx, "error@t.ca")
+		return errors.Errorf("failed")
+	}); err == nil {
+		t.Errorf("want error from failed transaction")
+	}
+	if count("error@t.ca") != 0 {
+		t.Errorf("insert not rolled back after error")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("want panic to be propagated")
+			}
+		}()
+		db.Tx(func(tx *Tx) error {
+			insert(tx, "panic@t.ca")
+			panic("failed")
+		})
+	}()
+	if count("panic@t.ca") != 0 {
+		t.Errorf("insert not rolled back after panic")
+	}
+}
+
+func TestInterruptedQuery(t *testing.T) {
+	db := newTestDB(t)
+	// counts to a large number to keep sqlite busy until it is interrupted
+	const slow = "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 100000000) SELECT count(*) AS n FROM c"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := db.WithContext(ctx).Query("select id from User", nil); !errors.Is(errors.Unavailable, err) {
+		t.Errorf("canceled context: want Unavailable error, got %v", err)
+	}
+	timed := *db
+	timed.queryTimeout = 10 * time.Millisecond
+	if _, _, err := timed.Query(slow, nil); !errors.Is(errors.Timeout, err) {
+		t.Errorf("slow query: want Timeout error, got %v", err)
+	}
+	if err := timed.Tx(func(tx *Tx) error {
+		_, _, err := tx.Query(slow, nil)
+		return err
+	}); !errors.Is(errors.Timeout, err) {
+		t.Errorf("slow transaction: want Timeout error, got %v", err)
+	}
+	// connections interrupted above are usable again
+	if _, _, err := db.Query("select id from User", nil); err != nil {
+		t.Errorf("query after interrupt: %v", err)
+	}
+}
+
+func TestConnectionSplit(t *testing.T) {
+	db := newTestDB(t)
+	if _, _, err := db.Query("INSERT INTO User(email, userName) Values('q@t.ca','q')", nil); err == nil {
+		t.Errorf("want error writing through a read connection")
+	}
+	check(t, db.Tx(func(tx *Tx) error {
+		rows, _, err := tx.Query("pragma synchronous", nil)
+		if err == nil && rows[0]["synchronous"] != int64(1) {
+			t.Errorf("want synchronous=normal (1) on the write connection, got %v", rows[0]["synchronous"])
+		}
+		return err
+	}))
+}
+
+// BenchmarkMixedReadWrite runs concurrent queries (like 80 wrk connections on a few cores),
+// writing on one in every n of them
+func BenchmarkMixedReadWrite(b *testing.B) {
+	defer func(debug bool) { errors.Debug = debug }(errors.Debug)
+	errors.Debug = false
+	for _, bm := range []struct {
+		name   string
+		writeN int // one write every writeN queries; 0 for reads only
+	}{
+		{"reads", 0},
+		{"writes=10%", 10},
+		{"writes=50%", 2},
+		{"writes", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			db := newTestDB(b)
+			addTestUsers(b, db, 100)
+			var seq int64
+			b.SetParallelism(80 / runtime.GOMAXPROCS(0))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					i++
+					var err error
+					if bm.writeN > 0 && i%bm.writeN == 0 {
+						n := atomic.AddInt64(&seq, 1)
+						_, _, err = db.Exec("UPDATE User SET bio=$bio WHERE id=$id", Args{"$bio": fmt.Sprint(n), "$id": n%100 + 1})
+					} else {
+						_, _, err = db.Query("SELECT * FROM User WHERE id=$id", Args{"$id": i%100 + 1})
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := newTestDB(t)
+	addTestUsers(t, db, 3)
+	_, _, err := db.Exec("UPDATE User SET image='t2.png' WHERE email='t2@t.ca'", nil)
+	check(t, err)
+
+	var users []userModel
+	n, err := db.Scan("select id, username, email, bio, image from User order by id", nil, &users)
+	check(t, err)
+	if n != 3 || len(users) != 3 {
+		t.Fatalf("want 3 users, got %d (%d rows)", len(users), n)
+	}
+	if users[0].Username != "t1" || users[0].Email != "t1@t.ca" || users[0].ID == 0 {
+		t.Errorf("wrong first user %+v", users[0])
+	}
+	if users[0].Image != nil || users[1].Image == nil || *users[1].Image != "t2.png" {
+		t.Errorf("want NULL image as nil and t2.png for t2, got %v and %v", users[0].Image, users[1].Image)
+	}
+
+	// a struct receives the first row; embedded struct fields and db tags are matched
+	var user struct {
+		userModel
+		Hash     []byte `db:"password"`
+		Confirmd bool   `db:"emailConfirmed"`
+	}
+	n, err = db.Scan("select id, username, emailConfirmed, CAST('secret' AS BLOB) AS password from User order by id",
+		nil, &user)
+	check(t, err)
+	if n != 3 || user.Username != "t1" || string(user.Hash) != "secret" || user.Confirmd {
+		t.Errorf("wrong user %+v (%d rows)", user, n)
+	}
+
+	var ptrs []*struct{ ID int64 }
+	n, err = db.Scan("select id from User where email=$email", Args{"$email": "none"}, &ptrs)
+	check(t, err)
+	if n != 0 || len(ptrs) != 0 {
+		t.Errorf("want no rows, got %d", n)
+	}
+
+	for _, tt := range []struct {
+		name string
+		dest interface{}
+	}{
+		{"column without field", &struct{ ID int64 }{}},
+		{"not a pointer", struct{ ID int64 }{}},
+		{"not a struct", new(int64)},
+		{"unsupported field type", &struct {
+			ID       int64
+			Username []string
+		}{}},
+	} {
+		if _, err := db.Scan("select id, username from User", nil, tt.dest); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
+
+// BenchmarkQueryRows compares reading rows into maps (Query) with scanning them into structs (Scan)
+func BenchmarkQueryRows(b *testing.B) {
+	defer func(debug bool) { errors.Debug = debug }(errors.Debug)
+	errors.Debug = false
+	db := newTestDB(b)
+	addTestUsers(b, db, 20)
+	const query = "select id, username, email, bio, image from User"
+	b.Run("map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, _, err := db.Query(query, nil)
+			check(b, err)
+			for _, row := range rows {
+				if _, ok := row["id"].(int64); !ok {
+					b.Fatal("id is not an int64")
+				}
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var users []userModel
+			_, err := db.Scan(query, nil, &users)
+			check(b, err)
+		}
+	})
+}
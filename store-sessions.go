@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/drgo/realworld/errors"
+	"github.com/drgo/realworld/sessions"
+)
+
+// sessionStore keeps sessions in the Session table of the app database so that they survive restarts
+type sessionStore struct {
+	db *sqlite
+}
+
+// Guarantee that sessionStore implements the sessions.Backend interface
+var _ sessions.Backend = (*sessionStore)(nil)
+
+// SessionBackend returns a sessions.Backend that keeps sessions in the store's database
+func (st *Store) SessionBackend() sessions.Backend {
+	return &sessionStore{db: st.db}
+}
+
+// UserStamp returns a value that changes when the password of user uid changes, so that
+// remembered sessions started before the change can be told apart. It is meant for
+// sessions.Sessions.UserStamp
+func (st *Store) UserStamp(uid int64) (string, error) {
+	var user struct{ Password string }
+	count, err := st.db.Scan("SELECT password FROM User WHERE id=$uid", Args{"$uid": uid}, &user)
+	if err != nil {
+		return "", errors.E(err, fmt.Sprintf("error retrieving user [%d]", uid))
+	}
+	if count == 0 {
+		return "", errors.E(errors.NotFound, "user not found")
+	}
+	// the password is hashed already; hashing it again keeps it out of the Session table
+	h := sha256.Sum256([]byte(user.Password))
+	return base64.RawURLEncoding.EncodeToString(h[:12]), nil
+}
+
+// sessionRow is a row of the Session table. Times are in Unix seconds
+type sessionRow struct {
+	ID          string
+	UserID      int64
+	CreatedAt   int64
+	LastActive  int64
+	ExpiresAt   int64
+	IdleTimeout int64
+	Remember    bool
+	UserStamp   string
+	UserAgent   string
+	IP          string
+}
+
+// sessionCols lists the columns of sessionRow
+const sessionCols = "id, userID, createdAt, lastActive, expiresAt, idleTimeout, remember, userStamp, userAgent, ip"
+
+func (row *sessionRow) session() *sessions.Session {
+	return &sessions.Session{
+		ID:          row.ID,
+		UserID:      row.UserID,
+		CreatedAt:   time.Unix(row.CreatedAt, 0),
+		LastActive:  time.Unix(row.LastActive, 0),
+		ExpiresAt:   time.Unix(row.ExpiresAt, 0),
+		IdleTimeout: time.Duration(row.IdleTimeout) * time.Second,
+		Remember:    row.Remember,
+		UserStamp:   row.UserStamp,
+		UserAgent:   row.UserAgent,
+		IP:          row.IP,
+	}
+}
+
+func (ss *sessionStore) Save(s *sessions.Session) error {
+	_, _, err := ss.db.Exec(`INSERT INTO Session (`+sessionCols+`, pruneAt)
+	VALUES ($id, $userID, $createdAt, $lastActive, $expiresAt, $idleTimeout, $remember, $userStamp,
+	$userAgent, $ip, $pruneAt)
+	ON CONFLICT (id) DO UPDATE SET lastActive=excluded.lastActive, pruneAt=excluded.pruneAt`, Args{
+		"$id": s.ID, "$userID": s.UserID, "$createdAt": s.CreatedAt.Unix(), "$lastActive": s.LastActive.Unix(),
+		"$expiresAt": s.ExpiresAt.Unix(), "$idleTimeout": int64(s.IdleTimeout / time.Second),
+		"$remember": s.Remember, "$userStamp": s.UserStamp, "$userAgent": s.UserAgent, "$ip": s.IP,
+		"$pruneAt": s.PruneAt().Unix(),
+	})
+	return err
+}
+
+func (ss *sessionStore) Load(id string) (*sessions.Session, error) {
+	var row sessionRow
+	count, err := ss.db.Scan("SELECT "+sessionCols+" FROM Session WHERE id=$id", Args{"$id": id}, &row)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	return row.session(), nil
+}
+
+func (ss *sessionStore) ListUser(uid int64) ([]*sessions.Session, error) {
+	var rows []sessionRow
+	if _, err := ss.db.Scan("SELECT "+sessionCols+" FROM Session WHERE userID=$userID",
+		Args{"$userID": uid}, &rows); err != nil {
+		return nil, err
+	}
+	list := make([]*sessions.Session, len(rows))
+	for i := range rows {
+		list[i] = rows[i].session()
+	}
+	return list, nil
+}
+
+func (ss *sessionStore) Delete(id string) error {
+	_, _, err := ss.db.Exec("DELETE FROM Session WHERE id=$id", Args{"$id": id})
+	return err
+}
+
+func (ss *sessionStore) DeleteUser(uid int64, keepID string) (int, error) {
+	n, _, err := ss.db.Exec("DELETE FROM Session WHERE userID=$userID AND id<>$id",
+		Args{"$userID": uid, "$id": keepID})
+	return n, err
+}
+
+func (ss *sessionStore) Prune(t time.Time) (int, error) {
+	n, _, err := ss.db.Exec("DELETE FROM Session WHERE pruneAt<$t", Args{"$t": t.Unix()})
+	return n, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/drgo/realworld/sessions"
+)
+
+// serveTest sends a request with body to s and returns the response
+func serveTest(t *testing.T, s *server, method, url, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	check(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	s := newTestServer(t)
+	rec := serveTest(t, s, "POST", "/api/users",
+		`{"user":{"username": "Jacob","email": "jake@jake.jake","password": "jakejake"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %v %s", rec.Code, rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	for _, cache := range []bool{true, false} {
+		// a new session manager on the same database stands for a restarted server
+		ss := sessions.NewSessionManager(cookieName, maxLifeTime, s.Store.SessionBackend(), cache)
+		t.Cleanup(ss.Finalize)
+		restarted := &server{Store: s.Store, Sessions: ss}
+		if rec := serveTest(t, restarted, "GET", "/api/user", "", cookies...); rec.Code != http.StatusOK {
+			t.Errorf("cache=%v: session lost after restart: got %v %s", cache, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	st := &Store{db: newTestDB(t)}
+	backend := st.SessionBackend()
+	now := time.Now()
+	day := now.Add(24 * time.Hour)
+	for _, s := range []*sessions.Session{
+		{ID: "a", UserID: 1, CreatedAt: now, LastActive: now, ExpiresAt: day, IdleTimeout: time.Hour,
+			Remember: true, UserStamp: "stamp"},
+		{ID: "b", UserID: 1, CreatedAt: now, LastActive: now.Add(-2 * time.Hour), ExpiresAt: day, IdleTimeout: time.Hour},
+		{ID: "c", UserID: 2, CreatedAt: now, LastActive: now, ExpiresAt: day, IdleTimeout: time.Hour},
+		{ID: "d", UserID: 1, CreatedAt: now, LastActive: now, ExpiresAt: now.Add(-time.Minute), IdleTimeout: time.Hour},
+	} {
+		check(t, backend.Save(s))
+	}
+	s, err := backend.Load("a")
+	check(t, err)
+	if s == nil || s.UserID != 1 || s.LastActive.Unix() != now.Unix() || s.ExpiresAt.Unix() != day.Unix() ||
+		s.IdleTimeout != time.Hour || !s.Remember || s.UserStamp != "stamp" {
+		t.Fatalf("wrong session loaded %+v", s)
+	}
+	s.LastActive = now.Add(time.Minute)
+	check(t, backend.Save(s))
+	if s, _ := backend.Load("a"); s.LastActive.Unix() != now.Add(time.Minute).Unix() {
+		t.Errorf("LastActive not updated, got %v", s.LastActive)
+	}
+	// b is idle for too long and d is past its absolute lifetime
+	if n, err := backend.Prune(now); err != nil || n != 2 {
+		t.Errorf("want 2 expired sessions pruned, got %d (%v)", n, err)
+	}
+	if s, _ := backend.Load("b"); s != nil {
+		t.Errorf("idle session not pruned")
+	}
+	if s, _ := backend.Load("d"); s != nil {
+		t.Errorf("session past its absolute lifetime not pruned")
+	}
+	if list, err := backend.ListUser(1); err != nil || len(list) != 1 || list[0].ID != "a" {
+		t.Errorf("want session a of user 1, got %v (%v)", list, err)
+	}
+	if n, err := backend.DeleteUser(1, "a"); err != nil || n != 0 {
+		t.Errorf("want no other session of user 1, got %d (%v)", n, err)
+	}
+	if n, err := backend.DeleteUser(2, ""); err != nil || n != 1 {
+		t.Errorf("want 1 session of user 2 deleted, got %d (%v)", n, err)
+	}
+	if s, err := backend.Load("none"); s != nil || err != nil {
+		t.Errorf("want nil session without error, got %v (%v)", s, err)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	s := newTestServer(t)
+	rec := serveTest(t, s, "POST", "/api/users",
+		`{"user":{"username": "Jacob","email": "jake@jake.jake","password": "jakejake"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %v %s", rec.Code, rec.Body)
+	}
+	old := rec.Result().Cookies()
+	if len(old) != 1 || len(old[0].Value) != 43 { // 32 random bytes in unpadded base64
+		t.Fatalf("want one cookie with a 43-character session ID, got %v", old)
+	}
+
+	rec = serveTest(t, s, "POST", "/api/user/refresh", "", old...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh: got %v %s", rec.Code, rec.Body)
+	}
+	refreshed := rec.Result().Cookies()
+	if len(refreshed) != 1 || refreshed[0].Value == old[0].Value {
+		t.Fatalf("want a new session cookie, got %v", refreshed)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", old...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old session after refresh: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", refreshed...); rec.Code != http.StatusOK {
+		t.Errorf("new session after refresh: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user/refresh", "", refreshed...); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET refresh: got %v, want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	// logging in again replaces the session the client holds
+	rec = serveTest(t, s, "POST", "/api/users/login",
+		`{"user":{"email": "jake@jake.jake","password": "jakejake"}}`, refreshed...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", refreshed...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session held before login: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", rec.Result().Cookies()...); rec.Code != http.StatusOK {
+		t.Errorf("session started by login: got %v %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionManagement(t *testing.T) {
+	s := newTestServer(t)
+	rec := serveTest(t, s, "POST", "/api/users",
+		`{"user":{"username": "Jacob","email": "jake@jake.jake","password": "jakejake"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %v %s", rec.Code, rec.Body)
+	}
+	first := rec.Result().Cookies()
+	rec = serveTest(t, s, "POST", "/api/users/login", `{"user":{"email": "jake@jake.jake","password": "jakejake"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: got %v %s", rec.Code, rec.Body)
+	}
+	second := rec.Result().Cookies()
+
+	rec = serveTest(t, s, "GET", "/api/user/sessions", "", first...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list sessions: got %v %s", rec.Code, rec.Body)
+	}
+	var resp struct{ Sessions []sessionModel }
+	check(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	if len(resp.Sessions) != 2 {
+		t.Fatalf("want 2 sessions, got %s", rec.Body)
+	}
+	var other string
+	for _, us := range resp.Sessions {
+		if us.ID == first[0].Value || us.ID == second[0].Value {
+			t.Errorf("session ID revealed in %s", rec.Body)
+		}
+		if !us.Current {
+			other = us.ID
+		}
+	}
+	if other == "" {
+		t.Fatalf("want one current session, got %s", rec.Body)
+	}
+
+	if rec := serveTest(t, s, "DELETE", "/api/user/sessions/"+other, "", first...); rec.Code != http.StatusNoContent {
+		t.Errorf("revoke session: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", second...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveTest(t, s, "DELETE", "/api/user/sessions/"+other, "", first...); rec.Code != http.StatusNotFound {
+		t.Errorf("revoke unknown session: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+
+	rec = serveTest(t, s, "POST", "/api/users/logout", "", first...)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: got %v %s", rec.Code, rec.Body)
+	}
+	if c := rec.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("want session cookie deleted on logout, got %v", c)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", first...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session after logout: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveTest(t, s, "POST", "/api/users/logout", "", first...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("logout without session: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRememberMe(t *testing.T) {
+	s := newTestServer(t)
+	s.Sessions.RevalidateInterval = 100 * time.Millisecond
+	rec := serveTest(t, s, "POST", "/api/users",
+		`{"user":{"username": "Jacob","email": "jake@jake.jake","password": "jakejake"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register: got %v %s", rec.Code, rec.Body)
+	}
+	if c := rec.Result().Cookies(); len(c) != 1 || c[0].MaxAge != 0 {
+		t.Errorf("want a browser session cookie after register, got %v", c)
+	}
+	plain := rec.Result().Cookies()
+	rec = serveTest(t, s, "POST", "/api/users/login",
+		`{"user":{"email": "jake@jake.jake","password": "jakejake","remember": true}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: got %v %s", rec.Code, rec.Body)
+	}
+	remembered := rec.Result().Cookies()
+	if len(remembered) != 1 || remembered[0].MaxAge < s.Sessions.RememberLifeTime-60 {
+		t.Fatalf("want a cookie kept for %ds, got %v", s.Sessions.RememberLifeTime, remembered)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", remembered...); rec.Code != http.StatusOK {
+		t.Errorf("remembered session: got %v %s", rec.Code, rec.Body)
+	}
+
+	// the password changes behind the server's back, eg reset by another process, and the server
+	// notices the next time it validates the cached session
+	_, _, err := s.Store.db.Exec("UPDATE User SET password='changed' WHERE email=$email",
+		Args{"$email": "jake@jake.jake"})
+	check(t, err)
+	time.Sleep(s.Sessions.RevalidateInterval)
+	if rec := serveTest(t, s, "GET", "/api/user", "", remembered...); rec.Code != http.StatusUnauthorized {
+		t.Errorf("remembered session after password change: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := serveTest(t, s, "GET", "/api/user", "", plain...); rec.Code != http.StatusOK {
+		t.Errorf("session that is not remembered: got %v %s", rec.Code, rec.Body)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/drgo/realworld/errors"
 	"github.com/drgo/realworld/utils"
@@ -12,7 +15,8 @@ import (
 // Args used to pass names and values of named arguments to queries
 type Args map[string]interface{}
 
-// Row represent an arbitrary table row
+// Row represent an arbitrary table row; NULL values are nil and BLOBs are []byte.
+// Use Scan to read rows into structs instead
 type Row map[string]interface{}
 
 // // DB is an interface that defines database functionality required by Store.
@@ -24,91 +28,297 @@ type Row map[string]interface{}
 // 	Exec(string, Args) (rowsAffected int, lastRowID int64, err error)
 // }
 
+// filter composes the conditions of a WHERE clause. Values are never concatenated
+// into the SQL text; each condition refers to a named argument bound through Args
+type filter struct {
+	conds []string
+	Args  Args
+}
+
+// newFilter returns a filter without conditions; args holds any other arguments of the query
+func newFilter(args Args) *filter {
+	if args == nil {
+		args = Args{}
+	}
+	return &filter{Args: args}
+}
+
+// And adds condition cond which refers to the named argument name bound to value
+func (f *filter) And(cond string, name string, value interface{}) *filter {
+	f.conds = append(f.conds, cond)
+	f.Args[name] = value
+	return f
+}
+
+// Where returns the WHERE clause combining all conditions or "" if there are none
+func (f *filter) Where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.conds, " AND ")
+}
+
 type Store struct {
 	db *sqlite
 }
 
 //TODO: inject DB into store to remove dependency on NewDB()
-func mustNewStore(dsn string) *Store {
-	store, err := newStore(dsn)
+func mustNewStore(dsn string, queryTimeout time.Duration) *Store {
+	store, err := newStore(dsn, queryTimeout)
 	if err != nil {
 		log.Fatalf("cannot create database %v", err)
 	}
 	return store
 }
 
-func newStore(dsn string) (*Store, error) {
+// newStore opens the database dsn, creating it if needed, and migrates it to the latest schema.
+// queryTimeout, if not zero, limits the time of each query or transaction run by the store
+func newStore(dsn string, queryTimeout time.Duration) (*Store, error) {
 	db, err := NewDB(dsn, DefaultPoolFlags, DefaultPoolSize)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.Migrate(-1); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.queryTimeout = queryTimeout
 	return &Store{
 		db: db,
 	}, nil
 }
 
+// WithContext returns a copy of the store whose queries are interrupted when ctx is done
+func (st *Store) WithContext(ctx context.Context) *Store {
+	return &Store{db: st.db.WithContext(ctx)}
+}
+
+// Tx runs fn in a transaction holding one connection for all its statements. The transaction is
+// committed if fn returns nil and rolled back if fn returns an error or panics.
+// Store methods that write more than one statement, or read what they wrote, use it
+func (st *Store) Tx(fn func(tx *Tx) error) error {
+	return st.db.Tx(fn)
+}
+
+// CreateUser adds a new user and returns its id.
+// Email or username already used by another user are reported as field errors
 func (st *Store) CreateUser(creds *credentials) (int64, error) {
-	query := `INSERT INTO User (username, email, password) 
+	// hash before taking the single writer connection as bcrypt is slow
+	hash, err := utils.HashedPassword(creds.User.Password)
+	if err != nil {
+		return 0, errors.E(err, "error creating user")
+	}
+	var id int64
+	err = st.Tx(func(tx *Tx) error {
+		query := `INSERT INTO User (username, email, password) 
 		VALUES ($username,$email,$passwordHash)`
-	_, id, err := st.db.Exec(query, Args{
-		"$username":     creds.User.Username,
-		"$email":        creds.User.Email,
-		"$passwordHash": utils.HashedPassword(creds.User.Password),
+		var err error
+		_, id, err = tx.Exec(query, Args{
+			"$username":     creds.User.Username,
+			"$email":        creds.User.Email,
+			"$passwordHash": hash,
+		})
+		if err != nil {
+			if fields := takenUserFields(tx, 0, &creds.User.Email, &creds.User.Username); len(fields) > 0 {
+				return errors.E(errors.Invalid, fields)
+			}
+		}
+		return err
 	})
-	return id, err
+	if err != nil {
+		return 0, errors.E(err, "error creating user")
+	}
+	return id, nil
 }
 
-func (st *Store) SignInByEmailAndPassword(email, password string) (Row, error) {
-	rows, count, err := st.db.Query("select id, password from User where email= $email", Args{"$email": email})
-	if err != nil || count == 0 {
-		return nil, errors.Errorf("user [%s] not found: %v", email, err)
+// UpdateUser changes the fields of user uid that are present (non-nil) in upd.
+// Email or username already used by another user are reported as field errors
+func (st *Store) UpdateUser(uid int64, upd *userUpdateModel) error {
+	u := &upd.User
+	args := Args{"$uid": uid}
+	var sets []string
+	set := func(col string, value interface{}) {
+		sets = append(sets, col+"=$"+col)
+		args["$"+col] = value
+	}
+	if u.Email != nil {
+		set("email", *u.Email)
+	}
+	if u.Username != nil {
+		set("username", *u.Username)
+	}
+	if u.Password != nil {
+		hash, err := utils.HashedPassword(*u.Password)
+		if err != nil {
+			return errors.E(err, "error updating user")
+		}
+		set("password", hash)
+	}
+	if u.Bio != nil {
+		set("bio", *u.Bio)
+	}
+	if u.Image.Set {
+		var image interface{} // NULL if the image was null
+		if u.Image.Value != nil {
+			image = *u.Image.Value
+		}
+		set("image", image)
+	}
+	if len(sets) == 0 { // nothing to change
+		return nil
+	}
+	err := st.Tx(func(tx *Tx) error {
+		query := "UPDATE User SET " + strings.Join(sets, ", ") + " WHERE id=$uid"
+		_, _, err := tx.Exec(query, args)
+		if err != nil {
+			if fields := takenUserFields(tx, uid, u.Email, u.Username); len(fields) > 0 {
+				return errors.E(errors.Invalid, fields)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return errors.E(err, "error updating user")
+	}
+	return nil
+}
+
+// takenUserFields reports which of email and username (if not nil) are used by users other than uid
+func takenUserFields(tx *Tx, uid int64, email, username *string) errors.Fields {
+	args := Args{"$uid": uid, "$email": "", "$username": ""}
+	if email != nil {
+		args["$email"] = *email
+	}
+	if username != nil {
+		args["$username"] = *username
+	}
+	var rows []struct{ Email, Username string }
+	if _, err := tx.Scan(`select email, username from User 
+	where id<>$uid AND (email=$email OR username=$username)`, args, &rows); err != nil {
+		return nil
+	}
+	fields := errors.Fields{}
+	for _, row := range rows {
+		if email != nil && row.Email == *email {
+			fields.Add("email", "has already been taken")
+		}
+		if username != nil && row.Username == *username {
+			fields.Add("username", "has already been taken")
+		}
+	}
+	return fields
+}
+
+// SignInByEmailAndPassword returns the user with email if password is theirs
+func (st *Store) SignInByEmailAndPassword(email, password string) (*userModel, error) {
+	var user struct {
+		userModel
+		Password string
+	}
+	count, err := st.db.Scan("select id, username, email, bio, image, password from User where email= $email",
+		Args{"$email": email}, &user)
+	if err != nil {
+		return nil, errors.E(err, "error retrieving user ["+email+"]")
+	}
+	if count == 0 {
+		return nil, errors.Errorf("user [%s] not found", email)
 	}
-	hashedPassword := rows[0]["password"].(string) // if it does not work, panic is ok
-	if !utils.ValidPassword(hashedPassword, password) {
+	if !utils.ValidPassword(user.Password, password) {
 		return nil, errors.Errorf("invalid password")
 	}
-	return rows[0], nil
+	return &user.userModel, nil
 }
 
-func (st *Store) GetUserJSON(uid int64) ([]byte, error) {
-	rows, count, err := st.db.Query(`select id, username, email, bio, image, random() as token from User 
-	where id= $uid`, Args{"$uid": uid})
-	if err != nil || count == 0 {
-		return nil, errors.Errorf("user not found: %v", err)
+// GetUserJSON returns user uid with the authentication token to be used by the client
+func (st *Store) GetUserJSON(uid int64, token string) ([]byte, error) {
+	const query = `SELECT json_object('user', json_object('username', username, 'email', email,
+	'bio', bio, 'image', image, 'token', $token))
+	FROM User WHERE id= $uid`
+	result, count, err := st.db.JSONQuery(query, Args{"$uid": uid, "$token": token})
+	if err != nil {
+		return nil, errors.E(err, "error retrieving user")
 	}
-	row := rows[0]
-	return json.Marshal(utils.Map{"user": row})
+	if count == 0 {
+		return nil, errors.E(errors.NotFound, "user not found")
+	}
+	return []byte(result), nil
 }
 
-func (st *Store) GetUserProfileJSON(userName string) ([]byte, error) {
-	rows, count, err := st.db.Query(`select id, username, bio, image, 0 as following from User
-	 where username= $username`, Args{"$username": userName})
-	if err != nil || count == 0 {
-		return nil, errors.Errorf("user not found: %v", err)
+// userProfileQuery returns the profile of $username as seen by $viewerID (0 if not authenticated)
+const userProfileQuery = `SELECT json_object('profile', json_object('username', username, 'bio', bio, 'image', image,
+	'following', json(CASE WHEN EXISTS (SELECT 1 FROM Follow WHERE userID=$viewerID AND followingID=User.id)
+		THEN 'true' ELSE 'false' END)))
+	FROM User WHERE username= $username`
+
+// GetUserProfileJSON returns the profile of userName as seen by viewerID (0 if not authenticated)
+func (st *Store) GetUserProfileJSON(userName string, viewerID int64) ([]byte, error) {
+	result, count, err := st.db.JSONQuery(userProfileQuery, Args{"$username": userName, "$viewerID": viewerID})
+	if err != nil {
+		return nil, errors.E(err, "error retrieving user")
+	}
+	if count == 0 {
+		return nil, errors.E(errors.NotFound, "user not found")
 	}
-	row := rows[0]
-	return json.Marshal(utils.Map{"profile": row})
+	return []byte(result), nil
 }
 
-//FIXME: handle null tags eg Case or coalsce
+// FollowUser makes followerID follow (or unfollow if follow is false) userName
+// and returns userName's profile as seen by followerID
+func (st *Store) FollowUser(userName string, followerID int64, follow bool) ([]byte, error) {
+	var query string
+	if follow {
+		query = `INSERT OR IGNORE INTO Follow(userID,followingID) SELECT $userID, id FROM User where
+		username=$username AND id<>$userID`
+	} else {
+		query = `DELETE FROM Follow WHERE userID=$userID AND followingID IN (SELECT id FROM User where username=$username)`
+	}
+	var result string
+	err := st.Tx(func(tx *Tx) error {
+		if _, _, err := tx.Exec(query, Args{"$userID": followerID, "$username": userName}); err != nil {
+			return err
+		}
+		var count int
+		var err error
+		result, count, err = tx.JSONQuery(userProfileQuery, Args{"$username": userName, "$viewerID": followerID})
+		if err == nil && count == 0 {
+			err = errors.E(errors.NotFound, "user not found")
+		}
+		return err
+	})
+	if err != nil {
+		return nil, errors.E(err, "error changing follow status for user ("+userName+")")
+	}
+	return []byte(result), nil
+}
+
+// favorited, favoritesCount and following are derived from the Favourite and Follow tables
+// for the viewer bound to $viewerID (0 if not authenticated)
 const articleQueryCols = `'id', a.id, 'slug', slug, 'title', title, 'description', description,
-'body', body, 'favorited', favourited, 'favoritesCount', favouritesCount,
+'body', body, 
+'favorited', json(CASE WHEN EXISTS (SELECT 1 FROM Favourite f WHERE f.articleID=a.id AND f.userID=$viewerID)
+	THEN 'true' ELSE 'false' END),
+'favoritesCount', (SELECT COUNT(*) FROM Favourite f WHERE f.articleID=a.id),
 'createdAt', DateTime(createdAt, 'unixepoch'), 'updatedAt', DateTime(updatedAt, 'unixepoch'),
-'tagList', COALESCE(json_extract(tags, '$'), json_array()) ,
-'author', json_object('username', u.username, 'bio', u.bio, 'image', u.image)`
+'tagList', (SELECT json_group_array(tag) FROM Tag WHERE articleID=a.id),
+'author', json_object('username', u.username, 'bio', u.bio, 'image', u.image,
+	'following', json(CASE WHEN EXISTS (SELECT 1 FROM Follow WHERE userID=$viewerID AND followingID=u.id)
+	THEN 'true' ELSE 'false' END))`
 
-const articleQueryJoins = `
-as JSON 
-FROM (select * from Article LIMIT $limit OFFSET $offset) a  
-INNER JOIN User AS u ON a.author=u.id 
-OUTER LEFT JOIN (SELECT articleID,json_group_array(tag) as tags FROM Tag GROUP BY articleID) t on a.id = t.articleID
- %s ORDER BY a.createdAt DESC;`
+// articleQueryFrom joins articles (a) and their authors (u); %[1]s is replaced by the WHERE clause
+const articleQueryFrom = `
+FROM Article a INNER JOIN User AS u ON a.author=u.id 
+%[1]s`
 
-const articleQueryList = `SELECT json_object('articles', json_group_array(
-	json_object(` + articleQueryCols + `)), 'articlesCount', 
-	COUNT(a.id))` + articleQueryJoins
+// the WHERE clause is applied before paging and articlesCount is the total number of
+// matching articles, not just those in the returned page
+const articleQueryList = `SELECT json_object('articles', (SELECT json_group_array(json(article)) FROM (
+	SELECT json_object(` + articleQueryCols + `) AS article` + articleQueryFrom + `
+	ORDER BY a.createdAt DESC, a.id DESC LIMIT $limit OFFSET $offset)),
+	'articlesCount', (SELECT COUNT(*)` + articleQueryFrom + `))
+as JSON;`
 
-const articleQuerySingle = `SELECT json_object('article',json_object(` + articleQueryCols + `))` + articleQueryJoins
+const articleQuerySingle = `SELECT json_object('article',json_object(` + articleQueryCols + `))
+as JSON` + articleQueryFrom + `;`
 
 type ListArticlesOptions struct {
 	Limit       int
@@ -117,6 +327,11 @@ type ListArticlesOptions struct {
 	Author      string
 	Tag         string
 	FavoritedBy string
+	// FeedOf if non-zero restricts the list to articles by authors followed by this user id
+	FeedOf int64
+	// ViewerID is the id of the authenticated user (0 if none) used to derive the favorited
+	// and following flags
+	ViewerID int64
 }
 
 func (st *Store) DefaultListArticlesOptions(slug string) *ListArticlesOptions {
@@ -129,23 +344,31 @@ func (st *Store) DefaultListArticlesOptions(slug string) *ListArticlesOptions {
 
 func (st *Store) ListArticlesJSON(opt *ListArticlesOptions) ([]byte, error) {
 	var query string
+	f := newFilter(Args{"$viewerID": opt.ViewerID})
 	// single article requested
 	if opt.Slug != "" {
-		where := "WHERE a.slug=" + "'" + opt.Slug + "'"
-		query = fmt.Sprintf(articleQuerySingle, where)
+		f.And("a.slug=$slug", "$slug", opt.Slug)
+		query = fmt.Sprintf(articleQuerySingle, f.Where())
 	} else { // multiple articles possibly filtered
-		where := "WHERE 1=1 "
 		if opt.Author != "" {
-			where = where + "AND u.username=" + "'" + opt.Author + "'"
+			f.And("u.username=$author", "$author", opt.Author)
 		}
 		if opt.Tag != "" {
-			where = where + "AND a.id IN (SELECT articleID FROM Tag WHERE tag='" + opt.Tag + "')"
+			f.And("a.id IN (SELECT articleID FROM Tag WHERE tag=$tag)", "$tag", opt.Tag)
+		}
+		if opt.FavoritedBy != "" {
+			f.And(`a.id IN (SELECT f.articleID FROM Favourite f INNER JOIN User fu ON f.userID=fu.id
+			WHERE fu.username=$favoritedBy)`, "$favoritedBy", opt.FavoritedBy)
+		}
+		if opt.FeedOf != 0 {
+			f.And("a.author IN (SELECT followingID FROM Follow WHERE userID=$feedOf)", "$feedOf", opt.FeedOf)
 		}
-		query = fmt.Sprintf(articleQueryList, where)
+		f.Args["$limit"], f.Args["$offset"] = opt.Limit, opt.Offset
+		query = fmt.Sprintf(articleQueryList, f.Where())
 	}
-	result, count, err := st.db.JSONQuery(query, Args{"$limit": opt.Limit, "$offset": opt.Offset})
+	result, count, err := st.db.JSONQuery(query, f.Args)
 	if err != nil {
-		return nil, errors.Errorf("error retrieving articles: %v", err)
+		return nil, errors.E(err, "error retrieving articles")
 	}
 	//FIXME: do we need to return an error?
 	if count != 1 {
@@ -154,50 +377,243 @@ func (st *Store) ListArticlesJSON(opt *ListArticlesOptions) ([]byte, error) {
 	return []byte(result), nil
 }
 
-//TODO: add a transaction
+// CreateArticle inserts art and its tags and returns the new article. The slug is derived from
+// the title and made unique by uniqueSlug
 func (st *Store) CreateArticle(art *articleModel) ([]byte, error) {
-	query := `INSERT INTO Article (slug,title,description,body,author) 
+	err := st.Tx(func(tx *Tx) error {
+		var err error
+		if art.Slug, err = uniqueSlug(tx, utils.Slugify(art.Title), 0); err != nil {
+			return err
+		}
+		query := `INSERT INTO Article (slug,title,description,body,author) 
 	VALUES ($slug,$title,$description,$body,$author)`
-	_, id, err := st.db.Exec(query, Args{
-		"$slug":        art.Slug,
-		"$title":       art.Title,
-		"$description": art.Description,
-		"$body":        art.Body,
-		"$author":      art.Author,
+		_, id, err := tx.Exec(query, Args{
+			"$slug":        art.Slug,
+			"$title":       art.Title,
+			"$description": art.Description,
+			"$body":        art.Body,
+			"$author":      art.Author,
+		})
+		if err != nil {
+			return err
+		}
+		query = `INSERT OR IGNORE INTO Tag (tag,articleID) VALUES ($tag,$articleID)`
+		for _, tag := range art.TagList {
+			if _, _, err = tx.Exec(query, Args{"$tag": tag, "$articleID": id}); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
-	query = `INSERT INTO Tag (tag,articleID) VALUES ($tag,$articleID)`
-	for _, tag := range art.TagList {
-		_, _, err = st.db.Exec(query, Args{"$tag": tag, "$articleID": id})
-	}
 	if err != nil {
-		return nil, errors.Errorf("error creating article (%s): %v", art.Title, err)
+		return nil, errors.E(err, "error creating article ("+art.Title+")")
 	}
 	opt := st.DefaultListArticlesOptions(art.Slug)
+	opt.ViewerID = art.Author
 	json, err := st.ListArticlesJSON(opt)
 	if err != nil {
-		return nil, errors.Errorf("error retrieving article (%s): %v", art.Title, err)
+		return nil, errors.E(err, "error retrieving article ("+art.Title+")")
 	}
 	return json, nil
 }
 
+// maxSlugSuffix is the length of the longest -N suffix that uniqueSlug can add
+const maxSlugSuffix = len("-9223372036854775807")
+
+// uniqueSlug returns slug if no article other than the one with id uses it, otherwise slug
+// followed by the first free suffix of -2, -3 etc. The slug is shortened if needed so that
+// the suffix fits in utils.MaxSlugLength. An empty slug (eg, a title without letters or digits)
+// is replaced by "article". The unique index on Article.slug guards against races
+func uniqueSlug(tx *Tx, slug string, id int64) (string, error) {
+	if slug == "" {
+		slug = "article"
+	}
+	// every candidate starts with the slug shortened for the longest suffix.
+	// slugs contain no LIKE wildcards (% or _) so it can be used as a pattern as is;
+	// the previous slugs of other articles are taken too so that their old links keep working
+	pattern := utils.TruncateSlug(slug, utils.MaxSlugLength-maxSlugSuffix) + "%"
+	var rows []struct{ Slug string }
+	if _, err := tx.Scan(`SELECT slug FROM Article WHERE slug LIKE $pattern AND id<>$id
+	UNION SELECT slug FROM SlugHistory WHERE slug LIKE $pattern AND articleID<>$id`,
+		Args{"$pattern": pattern, "$id": id}, &rows); err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		taken[row.Slug] = true
+	}
+	candidate := slug
+	for i := 2; taken[candidate]; i++ {
+		suffix := "-" + strconv.Itoa(i)
+		candidate = utils.TruncateSlug(slug, utils.MaxSlugLength-len(suffix)) + suffix
+	}
+	return candidate, nil
+}
+
+// UpdateArticle changes the fields of the article identified by slug that are present (non-nil) in upd
+// and returns the updated article. Only the author can update an article. Changing the title regenerates
+// the slug, keeping the old one in the slug history, and a tagList replaces all existing tags
+func (st *Store) UpdateArticle(slug string, authorID int64, upd *articleUpdateModel) ([]byte, error) {
+	err := st.Tx(func(tx *Tx) error {
+		var art struct{ ID, Author int64 }
+		count, err := tx.Scan("select id, author from Article where slug= $slug", Args{"$slug": slug}, &art)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.E(errors.NotFound, "no such article")
+		}
+		if art.Author != authorID {
+			return errors.E(errors.Permission, "only the author can change an article")
+		}
+		id := art.ID
+		args := Args{"$id": id}
+		var sets []string
+		set := func(col string, value interface{}) {
+			sets = append(sets, col+"=$"+col)
+			args["$"+col] = value
+		}
+		if upd.Title != nil {
+			newSlug, err := uniqueSlug(tx, utils.Slugify(*upd.Title), id)
+			if err != nil {
+				return err
+			}
+			if newSlug != slug {
+				if err := renameSlug(tx, id, slug, newSlug); err != nil {
+					return err
+				}
+				slug = newSlug
+			}
+			set("title", *upd.Title)
+			set("slug", slug)
+		}
+		if upd.Description != nil {
+			set("description", *upd.Description)
+		}
+		if upd.Body != nil {
+			set("body", *upd.Body)
+		}
+		if len(sets) > 0 {
+			query := "UPDATE Article SET " + strings.Join(sets, ", ") + " WHERE id=$id"
+			if _, _, err := tx.Exec(query, args); err != nil {
+				return err
+			}
+		}
+		if upd.TagList == nil { // tags unchanged
+			return nil
+		}
+		if _, _, err := tx.Exec("DELETE FROM Tag WHERE articleID=$articleID", Args{"$articleID": id}); err != nil {
+			return err
+		}
+		for _, tag := range upd.TagList {
+			_, _, err := tx.Exec("INSERT OR IGNORE INTO Tag (tag,articleID) VALUES ($tag,$articleID)",
+				Args{"$tag": tag, "$articleID": id})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.E(err, "error updating article ("+slug+")")
+	}
+	opt := st.DefaultListArticlesOptions(slug)
+	opt.ViewerID = authorID
+	json, err := st.ListArticlesJSON(opt)
+	if err != nil {
+		return nil, errors.E(err, "error retrieving article ("+slug+")")
+	}
+	return json, nil
+}
+
+// renameSlug records oldSlug in the slug history of article id so that links using it can be
+// redirected to newSlug, which is removed from the history in case the article is getting it back
+func renameSlug(tx *Tx, id int64, oldSlug, newSlug string) error {
+	if _, _, err := tx.Exec("INSERT OR REPLACE INTO SlugHistory (slug,articleID) VALUES ($slug,$articleID)",
+		Args{"$slug": oldSlug, "$articleID": id}); err != nil {
+		return err
+	}
+	_, _, err := tx.Exec("DELETE FROM SlugHistory WHERE slug=$slug", Args{"$slug": newSlug})
+	return err
+}
+
+// CurrentSlug returns the current slug of the article that used to be identified by oldSlug
+// before its title changed
+func (st *Store) CurrentSlug(oldSlug string) (string, error) {
+	var art struct{ Slug string }
+	count, err := st.db.Scan(`SELECT a.slug FROM SlugHistory h INNER JOIN Article a ON h.articleID=a.id
+	WHERE h.slug=$slug`, Args{"$slug": oldSlug}, &art)
+	if err != nil {
+		return "", errors.E(err, "error retrieving slug history ("+oldSlug+")")
+	}
+	if count == 0 {
+		return "", errors.E(errors.NotFound, "no such article")
+	}
+	return art.Slug, nil
+}
+
+// DeleteArticle deletes the article identified by slug together with its tags, favourites and comments.
+// Only the author can delete an article
+func (st *Store) DeleteArticle(slug string, authorID int64) error {
+	err := st.Tx(func(tx *Tx) error {
+		var art struct{ ID, Author int64 }
+		count, err := tx.Scan("select id, author from Article where slug= $slug", Args{"$slug": slug}, &art)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.E(errors.NotFound, "no such article")
+		}
+		if art.Author != authorID {
+			return errors.E(errors.Permission, "only the author can delete an article")
+		}
+		args := Args{"$id": art.ID}
+		for _, query := range []string{
+			"DELETE FROM Tag WHERE articleID=$id",
+			"DELETE FROM Favourite WHERE articleID=$id",
+			"DELETE FROM CommentHistory WHERE commentID IN (SELECT id FROM Comment WHERE articleID=$id)",
+			"DELETE FROM Comment WHERE articleID=$id",
+			"DELETE FROM SlugHistory WHERE articleID=$id",
+			"DELETE FROM Article WHERE id=$id",
+		} {
+			if _, _, err := tx.Exec(query, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.E(err, "error deleting article ("+slug+")")
+	}
+	return nil
+}
+
 func (st *Store) FavouriteArticle(slug string, userID int64, favourited bool) ([]byte, error) {
 	var query string
 	if favourited {
-		query = `INSERT INTO Favourite(userID,articleID) SELECT $userID, id FROM Article where
+		query = `INSERT OR IGNORE INTO Favourite(userID,articleID) SELECT $userID, id FROM Article where
 		slug=$slug`
 	} else {
 		query = `DELETE FROM Favourite WHERE userID=$userID AND articleID IN (SELECT id FROM Article where slug=$slug)`
 	}
-	_, _, err := st.db.Exec(query, Args{"$userID": userID, "$slug": slug})
-	if err != nil {
-		return nil, errors.Errorf("error changing favourite status for article (%s): %v", slug, err)
-	}
-	opt := st.DefaultListArticlesOptions(slug)
-	json, err := st.ListArticlesJSON(opt)
+	var result string
+	err := st.Tx(func(tx *Tx) error {
+		if _, _, err := tx.Exec(query, Args{"$userID": userID, "$slug": slug}); err != nil {
+			return err
+		}
+		f := newFilter(Args{"$viewerID": userID}).And("a.slug=$slug", "$slug", slug)
+		var count int
+		var err error
+		result, count, err = tx.JSONQuery(fmt.Sprintf(articleQuerySingle, f.Where()), f.Args)
+		if err == nil && count == 0 {
+			err = errors.E(errors.NotFound, "no such article")
+		}
+		return err
+	})
 	if err != nil {
-		return nil, errors.Errorf("error retrieving article (%s): %v", slug, err)
+		return nil, errors.E(err, "error changing favourite status for article ("+slug+")")
 	}
-	return json, nil
+	return []byte(result), nil
 }
 
 func (st *Store) ListTagsJSON() ([]byte, error) {
@@ -205,7 +621,7 @@ func (st *Store) ListTagsJSON() ([]byte, error) {
 		FROM (SELECT DISTINCT tag FROM Tag LIMIT $limit OFFSET $offset)`
 	result, count, err := st.db.JSONQuery(query, Args{"$limit": 100, "$offset": 0})
 	if err != nil {
-		return nil, errors.Errorf("error retrieving tags: %v", err)
+		return nil, errors.E(err, "error retrieving tags")
 	}
 	//FIXME: do we need to return an error?
 	if count != 1 {
@@ -214,48 +630,240 @@ func (st *Store) ListTagsJSON() ([]byte, error) {
 	return []byte(result), nil
 }
 
+// maxReplyDepth is the maximum nesting level of replies; replies to top-level comments are at level 1
+const maxReplyDepth = 5
+
+// CreateComment adds comment to the article identified by slug and returns the new comment.
+// A reply (comment.ParentID is not nil) must refer to a comment of the same article and cannot
+// be nested more than maxReplyDepth levels deep
 func (st *Store) CreateComment(comment *commentModel, slug string) ([]byte, error) {
-	query := `INSERT INTO Comment (author, body, articleID) SELECT $author, $body, id FROM Article where
-	slug=$slug`
-	_, _, err := st.db.Exec(query, Args{
-		"$author": comment.Author, "$body": comment.Body, "$slug": slug,
+	var id int64
+	err := st.Tx(func(tx *Tx) error {
+		var art struct{ ID int64 }
+		count, err := tx.Scan("SELECT id FROM Article WHERE slug=$slug", Args{"$slug": slug}, &art)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.E(errors.NotFound, "no such article")
+		}
+		articleID := art.ID
+		var parentID interface{} // bound as NULL for top-level comments
+		if comment.ParentID != nil {
+			parentID = *comment.ParentID
+			// the depth of the reply is the number of its ancestors
+			var parent struct{ Depth int }
+			if _, err := tx.Scan(`WITH RECURSIVE ancestor(id, parentID) AS (
+				SELECT id, parentID FROM Comment WHERE id=$parentID AND articleID=$articleID
+				UNION ALL SELECT c.id, c.parentID FROM Comment c INNER JOIN ancestor p ON c.id=p.parentID)
+			SELECT COUNT(*) AS depth FROM ancestor`, Args{"$parentID": *comment.ParentID, "$articleID": articleID},
+				&parent); err != nil {
+				return err
+			}
+			switch depth := parent.Depth; {
+			case depth == 0:
+				return errors.E(errors.Invalid, errors.Fields{"parentID": {"is invalid"}})
+			case depth > maxReplyDepth:
+				return errors.E(errors.Invalid, errors.Fields{"parentID": {
+					fmt.Sprintf("is nested too deeply (maximum is %d levels)", maxReplyDepth)}})
+			}
+		}
+		_, id, err = tx.Exec(`INSERT INTO Comment (author, body, articleID, parentID)
+		VALUES ($author, $body, $articleID, $parentID)`, Args{
+			"$author": comment.Author, "$body": comment.Body, "$articleID": articleID, "$parentID": parentID,
+		})
+		return err
 	})
 	if err != nil {
-		return nil, errors.Errorf("error creating comment (%s): %v", comment.Body, err)
+		return nil, errors.E(err, "error creating comment")
 	}
-	// opt := st.DefaultListArticlesOptions(slug)
-	// json, err := st.ListArticlesJSON(opt)
-	// if err != nil {
-	// 	return nil, errors.Errorf("error retrieving article (%s): %v", art.Title, err)
-	// }
-	return nil, nil
+	opt := st.DefaultListCommentsOptions(slug)
+	opt.CommentID = id
+	json, err := st.ListArticleCommentsJSON(opt)
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error retrieving comment (%d)", id))
+	}
+	return json, nil
+}
+
+// commentThreadIDs selects the id of comment $id and of all (direct or indirect) replies to it
+const commentThreadIDs = `WITH RECURSIVE thread(id) AS (
+	SELECT $id UNION ALL SELECT c.id FROM Comment c INNER JOIN thread t ON c.parentID=t.id)
+SELECT id FROM thread`
+
+// DeleteComment deletes comment commentID of the article identified by slug together with all
+// replies to it and their edit history. Only the author can delete a comment
+func (st *Store) DeleteComment(slug string, commentID int64, authorID int64) error {
+	err := st.Tx(func(tx *Tx) error {
+		if err := checkCommentAuthor(tx, slug, commentID, authorID); err != nil {
+			return err
+		}
+		args := Args{"$id": commentID}
+		for _, query := range []string{
+			"DELETE FROM CommentHistory WHERE commentID IN (" + commentThreadIDs + ")",
+			"DELETE FROM Comment WHERE id IN (" + commentThreadIDs + ")",
+		} {
+			if _, _, err := tx.Exec(query, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.E(err, fmt.Sprintf("error deleting comment (%d)", commentID))
+	}
+	return nil
+}
+
+// UpdateComment replaces the body of comment commentID of the article identified by slug and returns
+// the updated comment. The previous body is kept in the comment's edit history.
+// Only the author can update a comment
+func (st *Store) UpdateComment(slug string, commentID int64, authorID int64, body string) ([]byte, error) {
+	err := st.Tx(func(tx *Tx) error {
+		if err := checkCommentAuthor(tx, slug, commentID, authorID); err != nil {
+			return err
+		}
+		args := Args{"$id": commentID, "$body": body}
+		for _, query := range []string{
+			`INSERT INTO CommentHistory (commentID, body, createdAt) SELECT id, body, updatedAt FROM Comment
+			WHERE id=$id AND body<>$body`,
+			"UPDATE Comment SET body=$body, updatedAt=strftime('%s','now') WHERE id=$id AND body<>$body",
+		} {
+			if _, _, err := tx.Exec(query, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error updating comment (%d)", commentID))
+	}
+	opt := st.DefaultListCommentsOptions(slug)
+	opt.CommentID = commentID
+	json, err := st.ListArticleCommentsJSON(opt)
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error retrieving comment (%d)", commentID))
+	}
+	return json, nil
+}
+
+// checkCommentAuthor returns an error unless comment commentID of the article identified by slug
+// exists and authorID is its author
+func checkCommentAuthor(tx *Tx, slug string, commentID int64, authorID int64) error {
+	var comment struct{ Author int64 }
+	count, err := tx.Scan(`select c.author from Comment c, Article a 
+	where c.articleID=a.id AND c.id=$id AND a.slug=$slug`, Args{"$id": commentID, "$slug": slug}, &comment)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.E(errors.NotFound, "no such comment")
+	}
+	if comment.Author != authorID {
+		return errors.E(errors.Permission, "only the author can change a comment")
+	}
+	return nil
+}
+
+// ListCommentHistoryJSON returns the previous bodies of comment commentID of the article identified
+// by slug, most recent first. Only moderators can read the history of comments
+func (st *Store) ListCommentHistoryJSON(slug string, commentID int64, viewerID int64) ([]byte, error) {
+	var viewer struct{ Moderator bool }
+	count, err := st.db.Scan("SELECT moderator FROM User WHERE id=$id", Args{"$id": viewerID}, &viewer)
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error retrieving user (%d)", viewerID))
+	}
+	if count == 0 || !viewer.Moderator {
+		return nil, errors.E(errors.Permission, "only moderators can read the history of comments")
+	}
+	const query = `SELECT json_object('history', (SELECT json_group_array(json(version)) FROM (
+	SELECT json_object('body', h.body, 'createdAt', DateTime(h.createdAt, 'unixepoch'),
+		'replacedAt', DateTime(h.replacedAt, 'unixepoch')) AS version
+	FROM CommentHistory h WHERE h.commentID=$id ORDER BY h.replacedAt DESC, h.id DESC)))
+	as JSON FROM Comment c INNER JOIN Article a ON c.articleID=a.id WHERE c.id=$id AND a.slug=$slug;`
+	result, count, err := st.db.JSONQuery(query, Args{"$id": commentID, "$slug": slug})
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("error retrieving comment history (%d)", commentID))
+	}
+	if count != 1 {
+		return nil, errors.E(errors.NotFound, "no such comment")
+	}
+	return []byte(result), nil
 }
 
 const commentQueryCols = `'id', c.id, 'body', c.body, 'createdAt', DateTime(c.createdAt, 'unixepoch'), 
-'updatedAt', DateTime(c.updatedAt, 'unixepoch'),
+'updatedAt', DateTime(c.updatedAt, 'unixepoch'), 'parentID', c.parentID,
 'author', json_object('username', u.username, 'bio', u.bio, 'image', u.image)`
 
-const commentQueryJoins = `
-as JSON 
-FROM Comment c, Article a, User u 
-WHERE c.articleID= a.id AND c.author=u.id AND a.slug = $slug
-ORDER BY c.createdAt DESC;`
+// commentQueryFrom joins comments (c), their articles (a) and authors (u); %[1]s is replaced by the
+// WHERE clause
+const commentQueryFrom = `
+FROM Comment c INNER JOIN Article a ON c.articleID=a.id INNER JOIN User u ON c.author=u.id
+%[1]s`
+
+// commentQueryThread lists a page of top-level comments, sorted in direction %[1]s (ASC or DESC),
+// each followed by its replies in depth-first order. The sort key of a comment is its page rank
+// followed by the ids of its ancestors and its own id, zero-padded so that keys sort as text
+const commentQueryThread = `WITH RECURSIVE 
+root(id, key) AS (
+	SELECT c.id, printf('%%010d', row_number() OVER (ORDER BY c.createdAt %[1]s, c.id %[1]s))
+	FROM Comment c INNER JOIN Article a ON c.articleID=a.id
+	WHERE a.slug=$slug AND c.parentID IS NULL
+	ORDER BY c.createdAt %[1]s, c.id %[1]s LIMIT $limit OFFSET $offset),
+thread(id, key) AS (
+	SELECT id, key FROM root
+	UNION ALL SELECT c.id, t.key || '/' || printf('%%020d', c.id) FROM Comment c INNER JOIN thread t ON c.parentID=t.id)
+SELECT json_object('comments', (SELECT json_group_array(json(comment)) FROM (
+	SELECT json_object(` + commentQueryCols + `) AS comment
+	FROM thread t INNER JOIN Comment c ON c.id=t.id INNER JOIN User u ON c.author=u.id
+	ORDER BY t.key)))
+as JSON;`
 
-const commentQueryList = `SELECT json_object('comments', json_group_array(
-	json_object(` + commentQueryCols + `)))` + commentQueryJoins
+const commentQuerySingle = `SELECT json_object('comment',json_object(` + commentQueryCols + `))
+as JSON` + commentQueryFrom + `;`
 
-const commentQuerySingle = `SELECT json_object('comment',json_object(` + commentQueryCols + `))` + commentQueryJoins
+type ListCommentsOptions struct {
+	Slug string
+	// CommentID if non-zero selects a single comment
+	CommentID int64
+	// Limit is the number of top-level comments returned with their replies; -1 returns all
+	Limit  int
+	Offset int
+	// Ascending lists the oldest comments first
+	Ascending bool
+}
+
+func (st *Store) DefaultListCommentsOptions(slug string) *ListCommentsOptions {
+	return &ListCommentsOptions{
+		Slug:   slug,
+		Limit:  -1,
+		Offset: 0,
+	}
+}
 
-func (st *Store) ListArticleCommentsJSON(slug string, commentID int64) ([]byte, error) {
-	query := commentQueryList
-	//, "$commentID": commentID
-	result, count, err := st.db.JSONQuery(query, Args{"$slug": slug})
+// ListArticleCommentsJSON returns the comments of the article identified by opt.Slug in thread order
+// (see commentQueryThread) with top-level comments most recent first unless opt.Ascending is set,
+// or the single comment opt.CommentID
+func (st *Store) ListArticleCommentsJSON(opt *ListCommentsOptions) ([]byte, error) {
+	var query string
+	var args Args
+	if opt.CommentID != 0 {
+		f := newFilter(nil).And("a.slug=$slug", "$slug", opt.Slug).And("c.id=$commentID", "$commentID", opt.CommentID)
+		query, args = fmt.Sprintf(commentQuerySingle, f.Where()), f.Args
+	} else {
+		order := "DESC"
+		if opt.Ascending {
+			order = "ASC"
+		}
+		query = fmt.Sprintf(commentQueryThread, order)
+		args = Args{"$slug": opt.Slug, "$limit": opt.Limit, "$offset": opt.Offset}
+	}
+	result, count, err := st.db.JSONQuery(query, args)
 	if err != nil {
-		return nil, errors.Errorf("error retrieving comments: %v", err)
+		return nil, errors.E(err, "error retrieving comments")
 	}
-	//FIXME: do we need to return an error?
 	if count != 1 {
-		return nil, errors.Errorf("no such comments")
+		return nil, errors.E(errors.NotFound, "no such comment")
 	}
 	return []byte(result), nil
 }
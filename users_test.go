@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/drgo/realworld/sessions"
 )
 
-func check(t *testing.T, err error) {
+func check(t testing.TB, err error) {
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,13 +46,76 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusCreated,
-		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]+)"}}`,
 		"valid data and should return StatusCreated",
 	},
+	{
+		func(req *http.Request) {},
+		"/api/users/",
+		"POST",
+		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
+		http.StatusUnprocessableEntity,
+		`{"errors":{"email":\["has already been taken"\],"username":\["has already been taken"\]}}`,
+		"registered username and email should return StatusUnprocessableEntity",
+	},
+}
+
+// newTestServer returns a server using a new database in a temporary directory
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	store, err := newStore(filepath.Join(t.TempDir(), "rw.db"), 0)
+	check(t, err)
+	t.Cleanup(func() { store.db.Close() })
+	ss := sessions.NewSessionManager(cookieName, maxLifeTime, store.SessionBackend(), true)
+	ss.UserStamp = store.UserStamp
+	t.Cleanup(ss.Finalize)
+	return &server{Store: store, Sessions: ss}
+}
+
+// testUser is a registered user and the token that authenticates their requests
+type testUser struct {
+	Username string
+	Token    string
+}
+
+// registerTestUser registers username with a password of "password" and an email derived from username
+func registerTestUser(t *testing.T, s *server, username string) *testUser {
+	t.Helper()
+	rec := serveAs(t, s, nil, "POST", "/api/users", `{"user":{"username": "`+username+`","email": "`+
+		username+`@example.com","password": "password"}}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register %s: got %v %s", username, rec.Code, rec.Body)
+	}
+	var resp struct{ User struct{ Token string } }
+	decodeTest(t, rec, &resp)
+	return &testUser{Username: username, Token: resp.User.Token}
+}
+
+// serveAs sends a request with body to s authenticated by the token of u (or not authenticated
+// if u is nil) and returns the response
+func serveAs(t *testing.T, s *server, u *testUser, method, url, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	check(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if u != nil {
+		req.Header.Set("Authorization", "Token "+u.Token)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeTest decodes the JSON body of rec into v
+func decodeTest(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", rec.Body, err)
+	}
 }
 
 func TestWithoutAuth(t *testing.T) {
-	s := &server{}
+	s := newTestServer(t)
 	for _, td := range unauthRequestTests {
 		bodyData := td.bodyData
 		req, err := http.NewRequest(td.method, td.url, bytes.NewBufferString(bodyData))
@@ -65,3 +133,109 @@ func TestWithoutAuth(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateUser(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	registerTestUser(t, s, "celeb")
+	for _, tt := range []struct {
+		body  string
+		code  int
+		regex string
+	}{
+		{`{"user":{"bio": "I like to skateboard"}}`, http.StatusOK,
+			`"username":"jake","email":"jake@example.com","bio":"I like to skateboard"`},
+		{`{"user":{"email": "celeb@example.com"}}`, http.StatusUnprocessableEntity,
+			`{"errors":{"email":\["has already been taken"\]}}`},
+		{`{"user":{"username": "celeb"}}`, http.StatusUnprocessableEntity,
+			`{"errors":{"username":\["has already been taken"\]}}`},
+		{`{"user":{"email": "not an email"}}`, http.StatusUnprocessableEntity, `"email"`},
+		// bcrypt limits passwords to 72 bytes, here 37 characters
+		{`{"user":{"password": "` + strings.Repeat("é", 37) + `"}}`, http.StatusUnprocessableEntity,
+			`{"errors":{"password":\["is too long \(maximum is 72 bytes\)"\]}}`},
+		{`{"user":{"username": "jacob", "image": "https://example.com/jacob.png"}}`, http.StatusOK,
+			`"username":"jacob","email":"jake@example.com","bio":"I like to skateboard","image":"https://example.com/jacob.png"`},
+		{`{"user":{"bio": "I like to skate"}}`, http.StatusOK, `"image":"https://example.com/jacob.png"`},
+		{`{"user":{"image": null}}`, http.StatusOK, `"bio":"I like to skate","image":null`},
+	} {
+		rec := serveAs(t, s, jake, "PUT", "/api/user", tt.body)
+		if rec.Code != tt.code || !regexMatch(tt.regex, rec.Body.String()) {
+			t.Errorf("PUT %s: got %v %s, want %v %s", tt.body, rec.Code, rec.Body, tt.code, tt.regex)
+		}
+	}
+
+	// changing the password ends the other sessions of the user
+	rec := serveAs(t, s, nil, "POST", "/api/users/login", `{"user":{"email": "jake@example.com","password": "password"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second login: got %v %s", rec.Code, rec.Body)
+	}
+	var resp struct{ User struct{ Token string } }
+	decodeTest(t, rec, &resp)
+	other := &testUser{Username: "jacob", Token: resp.User.Token}
+	// the session that changed the password is rotated to the returned token
+	rec = serveAs(t, s, jake, "PUT", "/api/user", `{"user":{"password": "new password"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("password change: got %v %s", rec.Code, rec.Body)
+	}
+	decodeTest(t, rec, &resp)
+	if rec := serveAs(t, s, jake, "GET", "/api/user", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token from before the password change: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	jake.Token = resp.User.Token
+	if rec := serveAs(t, s, jake, "GET", "/api/user", ""); rec.Code != http.StatusOK {
+		t.Errorf("token returned by the password change: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, other, "GET", "/api/user", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other session after the password change: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+	rec = serveAs(t, s, jake, "GET", "/api/user/sessions", "")
+	var list struct{ Sessions []sessionModel }
+	decodeTest(t, rec, &list)
+	if rec.Code != http.StatusOK || len(list.Sessions) != 1 || !list.Sessions[0].Current {
+		t.Errorf("want only the current session listed after the password change, got %v %s", rec.Code, rec.Body)
+	}
+	for _, tt := range []struct {
+		password string
+		code     int
+	}{
+		{"password", http.StatusUnauthorized},
+		{"new password", http.StatusOK},
+	} {
+		rec := serveAs(t, s, nil, "POST", "/api/users/login",
+			`{"user":{"email": "jake@example.com","password": "`+tt.password+`"}}`)
+		if rec.Code != tt.code {
+			t.Errorf("login with %q: got %v, want %v", tt.password, rec.Code, tt.code)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	s := newTestServer(t)
+	jake := registerTestUser(t, s, "jake")
+	for _, tt := range []struct {
+		auth string
+		code int
+	}{
+		{"Token " + jake.Token, http.StatusOK},
+		{"Bearer " + jake.Token, http.StatusUnauthorized},
+		{jake.Token, http.StatusUnauthorized},
+		{"Token " + jake.Token + "x", http.StatusUnauthorized},
+		{"Token ", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest("GET", "/api/user", nil)
+		check(t, err)
+		req.Header.Set("Authorization", tt.auth)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("Authorization: %.20s...: got %v, want %v", tt.auth, rec.Code, tt.code)
+		}
+	}
+	// the token identifies a session, so it stops working once the session ends
+	if rec := serveAs(t, s, jake, "POST", "/api/users/logout", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: got %v %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(t, s, jake, "GET", "/api/user", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token after logout: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+}
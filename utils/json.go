@@ -69,6 +69,19 @@ func DecodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 	return nil
 }
 
+// NullString is a string field of an update payload that tells a missing key (Set is false)
+// from an explicit null (Set is true and Value is nil)
+type NullString struct {
+	Set   bool
+	Value *string
+}
+
+// UnmarshalJSON records that the key was present; it is only called for keys in the payload
+func (ns *NullString) UnmarshalJSON(b []byte) error {
+	ns.Set = true
+	return json.Unmarshal(b, &ns.Value)
+}
+
 // JSON encodes v as JSON and write it to http.ResponseWriter
 func JSON(w http.ResponseWriter, status int, v interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
@@ -2,57 +2,59 @@ package utils
 
 // source https://github.com/chilledoj/realworld-starter-kit
 import (
+	"fmt"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
-var tokenSecret = []byte("All-your-base")
+// tokenSecret signs the tokens; set RW_TOKEN_SECRET in production
+var tokenSecret = []byte(EnvOrDefault("RW_TOKEN_SECRET", "All-your-base"))
 
 // Token represents the JWT token
 type Token string
 
-// TokenClaims is a custom claims struct for JWT
+// TokenClaims is a custom claims struct for JWT.
+// The standard Id (jti) claim holds the ID of the session the token belongs to
 type TokenClaims struct {
-	// User *userModel
+	UserID int64 `json:"uid"`
 	jwt.StandardClaims
 }
 
-const jwtExpiryDuration = time.Hour * 24 * 7 // ~7 days
-
-// // NewToken generates a new JWT token, using User
-// func NewToken(u *userModel) (string, error) {
-// 	claims := TokenClaims{
-// 		u,
-// 		jwt.StandardClaims{
-// 			ExpiresAt: time.Now().Add(jwtExpiryDuration).Unix(),
-// 			Issuer:    "golang-gorilla-conduit",
-// 		},
-// 	}
-
-// 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-// 	ss, err := token.SignedString(tokenSecret)
-// 	if err != nil {
-// 		return "", err
-// 	}
-// 	return ss, nil
-// }
+// NewToken generates a new JWT token for user userID and session sessionID that expires,
+// like the session, at expiresAt
+func NewToken(userID int64, sessionID string, expiresAt time.Time) (string, error) {
+	claims := TokenClaims{
+		userID,
+		jwt.StandardClaims{
+			Id:        sessionID,
+			ExpiresAt: expiresAt.Unix(),
+			Issuer:    "golang-native-realworld-app",
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	ss, err := token.SignedString(tokenSecret)
+	if err != nil {
+		return "", err
+	}
+	return ss, nil
+}
 
-// // ValidateToken validates the JWT and returns the claims
-// func ValidateToken(tokenString string) (*TokenClaims, error) {
-// 	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-// 		_, ok := token.Method.(*jwt.SigningMethodHMAC)
-// 		if !ok {
-// 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-// 		}
-// 		return tokenSecret, nil
-// 	})
-// 	if err != nil {
-// 		return nil, err
-// 	}
-// 	claims, ok := token.Claims.(*TokenClaims)
-// 	if !ok || !token.Valid {
-// 		return nil, fmt.Errorf("Token not valid")
-// 	}
-// 	return claims, nil
-// }
+// ValidateToken validates the JWT and returns the claims
+func ValidateToken(tokenString string) (*TokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		_, ok := token.Method.(*jwt.SigningMethodHMAC)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return tokenSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*TokenClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("Token not valid")
+	}
+	return claims, nil
+}
@@ -1,20 +1,25 @@
 package utils
 
 import (
+	"fmt"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 const numberOfTrials = 5
 
-func HashedPassword(password string) string {
+// HashedPassword returns the bcrypt hash of password, retrying up to numberOfTrials times.
+// bcrypt ignores all but the first 72 bytes of password so longer ones must be rejected beforehand
+func HashedPassword(password string) (string, error) {
 	var err error
 	for i := 0; i < numberOfTrials; i++ {
-		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		var hash []byte
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err == nil {
-			return string(hash)
+			return string(hash), nil
 		}
 	}
-	panic("HashPassword failed: " + err.Error())
+	return "", fmt.Errorf("error hashing password: %v", err)
 }
 
 func ValidPassword(hashedPassword string, password string) bool {
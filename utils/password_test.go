@@ -0,0 +1,13 @@
+package utils
+
+import "testing"
+
+func TestHashedPassword(t *testing.T) {
+	hash, err := HashedPassword("jakejake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidPassword(hash, "jakejake") || ValidPassword(hash, "jakejak") {
+		t.Errorf("HashedPassword(jakejake) = %q does not match only jakejake", hash)
+	}
+}
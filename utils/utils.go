@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/drgo/realworld/errors"
 )
@@ -60,21 +61,78 @@ func GetUniqueID() int64 {
 	return time.Now().UnixNano()
 }
 
-//FIXME: add dashes for intermediate spaces
-// Slugify returns a string that does not contain white characters,
-// punctuation, all letters are lower case.
-// It could contain `-` but not at the beginning or end of the text.
-// TODO: It should be in range of the MaxLength var if specified
+// MaxSlugLength is the maximum number of characters in a slug returned by Slugify
+const MaxSlugLength = 80
+
+// transliterations maps lower-case accented Latin letters to their closest ASCII spelling
+var transliterations = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e", 'ğ': "g",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i", 'ł': "l", 'ľ': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ő': "o", 'œ': "oe", 'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t",
+	'þ': "th", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// Slugify returns a URL-friendly version of s made of its words (runs of letters and digits)
+// in lower case, separated by `-`. Accented Latin letters are transliterated and apostrophes
+// dropped, eg "Don't Eat Crème Brûlée" gives "dont-eat-creme-brulee". Words that would make
+// the slug longer than MaxSlugLength characters are left out (a first word that is too long is cut)
 func Slugify(s string) string {
-	var sb strings.Builder
+	var words []string
+	var w strings.Builder
+	flush := func() {
+		if w.Len() > 0 {
+			words = append(words, w.String())
+			w.Reset()
+		}
+	}
 	for _, r := range s {
-		if unicode.IsLetter(r) {
-			sb.WriteRune(unicode.ToLower(r))
+		r = unicode.ToLower(r)
+		if t, ok := transliterations[r]; ok {
+			w.WriteString(t)
+			continue
+		}
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			w.WriteRune(r)
+		case r == '\'' || r == '’': // dropped, eg "don't" gives "dont"
+		default:
+			flush()
 		}
 	}
+	flush()
+	var sb strings.Builder
+	n := 0 // characters in sb
+	for _, word := range words {
+		wn := utf8.RuneCountInString(word)
+		if n == 0 && wn > MaxSlugLength {
+			return string([]rune(word)[:MaxSlugLength])
+		}
+		if n > 0 {
+			if n+1+wn > MaxSlugLength {
+				break
+			}
+			sb.WriteByte('-')
+			n++
+		}
+		sb.WriteString(word)
+		n += wn
+	}
 	return sb.String()
 }
 
+// TruncateSlug returns slug cut to at most n characters, without a trailing `-`
+func TruncateSlug(slug string, n int) string {
+	r := []rune(slug)
+	if len(r) <= n {
+		return slug
+	}
+	return strings.TrimRight(string(r[:n]), "-")
+}
+
 func EnvOrDefault(key, alt string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
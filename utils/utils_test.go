@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"How to train your dragon", "how-to-train-your-dragon"},
+		{"Go 1.16 Tips", "go-1-16-tips"},
+		{"  --Hello,   World!-- ", "hello-world"},
+		{"Don't Eat Crème Brûlée", "dont-eat-creme-brulee"},
+		{"Straße in Łódź", "strasse-in-lodz"},
+		{"Привет мир", "привет-мир"},
+		{"?!", ""},
+		{strings.Repeat("word ", 20), strings.TrimSuffix(strings.Repeat("word-", 16), "-")},
+		{strings.Repeat("x", 100), strings.Repeat("x", MaxSlugLength)},
+	}
+	for _, tt := range tests {
+		if got := Slugify(tt.in); got != tt.want {
+			t.Errorf("Slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateSlug(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"how-to-train", 20, "how-to-train"},
+		{"how-to-train", 7, "how-to"},
+		{"how-to-train", 8, "how-to-t"},
+		{"привет-мир", 6, "привет"},
+	}
+	for _, tt := range tests {
+		if got := TruncateSlug(tt.in, tt.n); got != tt.want {
+			t.Errorf("TruncateSlug(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
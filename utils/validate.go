@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/drgo/realworld/errors"
+)
+
+// Validate checks the fields of the struct pointed to by v against the rules listed in
+// their `validate` tags and returns the problems found keyed by the fields' json names
+// (eg {"email": ["can't be blank"]}) or nil if there are none.
+// Supported rules (comma-separated, checked in order, only the first failure is reported):
+//
+//	required    the field must not be blank
+//	email       the field must be a plain email address, eg jake@jake.jake
+//	min=n       strings must have at least n characters
+//	max=n       strings must have at most n characters and slices at most n elements
+//	maxbytes=n  strings must be at most n bytes long in UTF-8, eg for bcrypt's 72-byte limit
+//
+// Nested structs are checked recursively. Nil pointers and NullStrings that are missing or
+// null are skipped so that the fields of update payloads are only checked if present
+func Validate(v interface{}) errors.Fields {
+	fields := errors.Fields{}
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), fields)
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func validateStruct(sv reflect.Value, fields errors.Fields) {
+	st := sv.Type()
+	for i := 0; i < st.NumField(); i++ {
+		fv := sv.Field(i)
+		if ns, ok := fv.Interface().(NullString); ok {
+			fv = reflect.ValueOf(ns.Value)
+		}
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			validateStruct(fv, fields)
+			continue
+		}
+		rules := st.Field(i).Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := strings.Split(st.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = st.Field(i).Name
+		}
+		for _, rule := range strings.Split(rules, ",") {
+			if msg := checkRule(rule, fv); msg != "" {
+				fields.Add(name, msg)
+				break
+			}
+		}
+	}
+}
+
+// checkRule returns a message describing why v breaks rule or "" if it does not
+func checkRule(rule string, v reflect.Value) string {
+	name, n := rule, 0
+	if i := strings.IndexByte(rule, '='); i >= 0 {
+		var err error
+		name = rule[:i]
+		if n, err = strconv.Atoi(rule[i+1:]); err != nil {
+			panic("validate: invalid rule " + rule)
+		}
+	}
+	switch name {
+	case "required":
+		if v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "" || v.IsZero() {
+			return "can't be blank"
+		}
+	case "email":
+		if s := v.String(); s != "" {
+			if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+				return "is invalid"
+			}
+		}
+	case "min":
+		if length(v) < n {
+			return fmt.Sprintf("is too short (minimum is %d characters)", n)
+		}
+	case "max":
+		if v.Kind() == reflect.Slice && v.Len() > n {
+			return fmt.Sprintf("is too long (maximum is %d items)", n)
+		}
+		if length(v) > n {
+			return fmt.Sprintf("is too long (maximum is %d characters)", n)
+		}
+	case "maxbytes":
+		if v.Kind() == reflect.String && len(v.String()) > n {
+			return fmt.Sprintf("is too long (maximum is %d bytes)", n)
+		}
+	default:
+		panic("validate: unknown rule " + rule)
+	}
+	return ""
+}
+
+// length returns the number of characters in string v or 0 for other kinds
+func length(v reflect.Value) int {
+	if v.Kind() != reflect.String {
+		return 0
+	}
+	return utf8.RuneCountInString(v.String())
+}
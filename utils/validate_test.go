@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/drgo/realworld/errors"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+type testUser struct {
+	User struct {
+		Username string     `json:"username" validate:"required,max=5"`
+		Email    string     `json:"email" validate:"required,email"`
+		Password string     `json:"password" validate:"required,min=3,maxbytes=10"`
+		Bio      *string    `json:"bio" validate:"required"`
+		Tags     []string   `json:"tags" validate:"max=1"`
+		Image    NullString `json:"image" validate:"max=5"`
+	} `json:"user"`
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		init func(u *testUser)
+		want errors.Fields
+	}{
+		{"valid", func(u *testUser) {}, nil},
+		{"blank", func(u *testUser) { u.User.Username, u.User.Email = " ", "" },
+			errors.Fields{"username": {"can't be blank"}, "email": {"can't be blank"}}},
+		{"too long", func(u *testUser) { u.User.Username = "jacobs" },
+			errors.Fields{"username": {"is too long (maximum is 5 characters)"}}},
+		{"not too long in characters", func(u *testUser) { u.User.Username = "jäcöb" }, nil},
+		{"too short", func(u *testUser) { u.User.Password = "ab" },
+			errors.Fields{"password": {"is too short (minimum is 3 characters)"}}},
+		{"too long in bytes", func(u *testUser) { u.User.Password = "jäcöbjäcöb" },
+			errors.Fields{"password": {"is too long (maximum is 10 bytes)"}}},
+		{"bad email", func(u *testUser) { u.User.Email = "Jake <jake@jake.jake>" },
+			errors.Fields{"email": {"is invalid"}}},
+		{"present pointer", func(u *testUser) { u.User.Bio = strPtr("") },
+			errors.Fields{"bio": {"can't be blank"}}},
+		{"too many items", func(u *testUser) { u.User.Tags = []string{"a", "b"} },
+			errors.Fields{"tags": {"is too long (maximum is 1 items)"}}},
+		{"null string", func(u *testUser) { u.User.Image = NullString{Set: true} }, nil},
+		{"too long null string", func(u *testUser) { u.User.Image = NullString{Set: true, Value: strPtr("jacob.png")} },
+			errors.Fields{"image": {"is too long (maximum is 5 characters)"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var u testUser
+			u.User.Username, u.User.Email, u.User.Password = "jake", "jake@jake.jake", "jakejake"
+			tt.init(&u)
+			if got := Validate(&u); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}